@@ -18,12 +18,24 @@ import (
 var router mux.Router
 
 func Start() {
-	router := mux.NewRouter()
 	//cors
 	credentials := handlers.AllowCredentials()
 	methods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"})
 	origins := handlers.AllowedOrigins([]string{"https://proteje.netlify.app/*", "https://proteje.netlify.app", "https://proteje.herokuapp.com/*", "https://proteje.herokuapp.com", "*"})
 
+	destiny.Manifest.Start() //router.HandleFunc("/api/destiny/generatemanifest/", destiny.GenerateManifest).Methods("GET")
+	destiny.CheckBuildsOnStartup()
+
+	log.Fatal(http.ListenAndServe(":9200", handlers.CORS(credentials, methods, origins)(NewRouter()))) //
+
+}
+
+// NewRouter registers every endpoint. Mux tries routes in order, so literal paths come before
+// the patterns that would swallow them and bare build ids only match destiny.BuildIDPattern.
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	buildID := "{id:" + destiny.BuildIDPattern + "}"
+
 	//endpoints
 	router.HandleFunc("/api/", functions.Front).Methods("GET")
 	router.HandleFunc("/api/sup/", functions.Sup).Methods("GET")
@@ -32,12 +44,30 @@ func Start() {
 	router.HandleFunc("/api/youtube/", youtube.GetPlaylist).Methods("GET")
 	router.HandleFunc("/api/youtube/", youtube.PutTimerOnVidsTitle).Methods("PUT")
 
-	destiny.GenerateManifest() //router.HandleFunc("/api/destiny/generatemanifest/", destiny.GenerateManifest).Methods("GET")
+	router.HandleFunc("/api/destiny/manifest/status", destiny.GetManifestStatus).Methods("GET")
+	router.HandleFunc("/api/destiny/manifest/cache", destiny.GetCacheStats).Methods("GET")
 	router.HandleFunc("/api/destiny/builds/", destiny.GetBuilds).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/validate", destiny.GetBuildsValidation).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/share/{code}", destiny.GetSharedBuild).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/diff", destiny.GetBuildsDiff).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/import", destiny.PostBuildImport).Methods("POST")
+	router.HandleFunc("/api/destiny/builds/{class}/", destiny.PostBuild).Methods("POST")
+	router.HandleFunc("/api/destiny/builds/"+buildID+"/export", destiny.GetBuildExport).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/"+buildID+"/history", destiny.GetBuildHistory).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/"+buildID+"/revisions/{n}", destiny.GetBuildRevision).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/"+buildID+"/rollback/{n}", destiny.PostBuildRollback).Methods("POST")
+	router.HandleFunc("/api/destiny/builds/"+buildID+"/plan", destiny.PostBuildPlan).Methods("POST")
+	router.HandleFunc("/api/destiny/builds/{class}/{id}/share", destiny.GetBuildShareCode).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/{class}/{id}", destiny.GetBuild).Methods("GET")
+	router.HandleFunc("/api/destiny/builds/{class}/{id}", destiny.PostBuild).Methods("POST")
+	router.HandleFunc("/api/destiny/builds/{class}/{id}", destiny.PutBuild).Methods("PUT")
+	router.HandleFunc("/api/destiny/builds/{class}/{id}", destiny.DeleteBuild).Methods("DELETE")
+	router.HandleFunc("/api/destiny/items/search", destiny.SearchItems).Methods("GET")
+	router.HandleFunc("/api/destiny/items/{hash}", destiny.GetItemDetail).Methods("GET")
+	router.HandleFunc("/api/destiny/items/{hash}/godroll", destiny.GetGodRoll).Methods("GET")
 	//router.HandleFunc("/api/destiny/query/", destiny.DestinyManifestQuery).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(":9200", handlers.CORS(credentials, methods, origins)(router))) //
-
+	return router
 }
 
 func addEndpoint(endpoint string, menthod string, function func(w http.ResponseWriter, router *http.Request)) {
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routeTests pair a request with the route template it has to end up at
+var routeTests = []struct {
+	method, path, template string
+}{
+	{"GET", "/api/destiny/builds/", "/api/destiny/builds/"},
+	{"GET", "/api/destiny/builds/validate", "/api/destiny/builds/validate"},
+	{"POST", "/api/destiny/builds/warlock/", "/api/destiny/builds/{class}/"},
+	{"GET", "/api/destiny/builds/warlock/0123456789abcdef", "/api/destiny/builds/{class}/{id}"},
+	{"POST", "/api/destiny/builds/warlock/0123456789abcdef", "/api/destiny/builds/{class}/{id}"},
+	{"PUT", "/api/destiny/builds/titan/0123456789abcdef", "/api/destiny/builds/{class}/{id}"},
+	{"DELETE", "/api/destiny/builds/hunter/0123456789abcdef", "/api/destiny/builds/{class}/{id}"},
+	{"GET", "/api/destiny/builds/warlock/0123456789abcdef/share", "/api/destiny/builds/{class}/{id}/share"},
+	{"GET", "/api/destiny/builds/0123456789abcdef/export", "/api/destiny/builds/{id:[0-9a-f]{16}}/export"},
+	{"GET", "/api/destiny/builds/warlock/export", "/api/destiny/builds/{class}/{id}"},
+	{"GET", "/api/destiny/builds/0123456789abcdef/history", "/api/destiny/builds/{id:[0-9a-f]{16}}/history"},
+	{"GET", "/api/destiny/builds/titan/history", "/api/destiny/builds/{class}/{id}"},
+	{"GET", "/api/destiny/builds/0123456789abcdef/revisions/2", "/api/destiny/builds/{id:[0-9a-f]{16}}/revisions/{n}"},
+	{"POST", "/api/destiny/builds/0123456789abcdef/rollback/2", "/api/destiny/builds/{id:[0-9a-f]{16}}/rollback/{n}"},
+	{"POST", "/api/destiny/builds/0123456789abcdef/plan", "/api/destiny/builds/{id:[0-9a-f]{16}}/plan"},
+	{"POST", "/api/destiny/builds/hunter/plan", "/api/destiny/builds/{class}/{id}"},
+	{"GET", "/api/destiny/items/search", "/api/destiny/items/search"},
+	{"GET", "/api/destiny/items/1363886209", "/api/destiny/items/{hash}"},
+}
+
+func TestRoutes(t *testing.T) {
+	router := NewRouter()
+	for _, test := range routeTests {
+		var match mux.RouteMatch
+		if !router.Match(httptest.NewRequest(test.method, test.path, nil), &match) || match.Route == nil {
+			t.Errorf("%s %s matched no route", test.method, test.path)
+			continue
+		}
+		template, _ := match.Route.GetPathTemplate()
+		if template != test.template {
+			t.Errorf("%s %s went to %s, expected %s", test.method, test.path, template, test.template)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package destiny
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"projector/controllers/functions"
+	"sort"
+)
+
+// DiffItem is a hash of a diff together with its name in the manifest
+type DiffItem struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+}
+
+// Change is one difference between two builds. Type is added, removed or changed,
+// Field is item or the name of a list, or name and preference with an empty Slot for the build itself.
+type Change struct {
+	Type  string      `json:"type"`
+	Slot  string      `json:"slot,omitempty"`
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+type BuildDiff struct {
+	A       diffSide `json:"a"`
+	B       diffSide `json:"b"`
+	Changes []Change `json:"changes"`
+}
+
+type diffSide struct {
+	ID    string `json:"id,omitempty"`
+	Class string `json:"class"`
+	Name  string `json:"name"`
+}
+
+// DiffBuilds compares two builds slot by slot, names looks up the manifest name of a hash
+func DiffBuilds(a, b Class, names func(id string) DiffItem) []Change {
+	changes := make([]Change, 0)
+	if a.Name != b.Name {
+		changes = append(changes, Change{Type: "changed", Field: "name", From: a.Name, To: b.Name})
+	}
+	if !equalStrings(a.Preference, b.Preference) {
+		changes = append(changes, Change{Type: "changed", Field: "preference", From: a.Preference, To: b.Preference})
+	}
+
+	changes = append(changes, diffSlot("subclass", a.Subclass, b.Subclass, names)...)
+
+	slots := make(map[string]bool)
+	for name := range a.Slots {
+		slots[name] = true
+	}
+	for name := range b.Slots {
+		slots[name] = true
+	}
+	ordered := make([]string, 0, len(slots))
+	for name := range slots {
+		ordered = append(ordered, name)
+	}
+	sort.Strings(ordered)
+
+	for _, name := range ordered {
+		changes = append(changes, diffSlot(name, a.Slots[name], b.Slots[name], names)...)
+	}
+	return changes
+}
+
+func diffSlot(name string, a, b Slot, names func(id string) DiffItem) []Change {
+	var changes []Change
+	switch {
+	case a.Item == b.Item:
+	case a.Item == "":
+		changes = append(changes, Change{Type: "added", Slot: name, Field: "item", To: names(b.Item)})
+	case b.Item == "":
+		changes = append(changes, Change{Type: "removed", Slot: name, Field: "item", From: names(a.Item)})
+	default:
+		changes = append(changes, Change{Type: "changed", Slot: name, Field: "item", From: names(a.Item), To: names(b.Item)})
+	}
+
+	lists := make(map[string]bool)
+	for list := range a.Lists {
+		lists[list] = true
+	}
+	for list := range b.Lists {
+		lists[list] = true
+	}
+	ordered := make([]string, 0, len(lists))
+	for list := range lists {
+		ordered = append(ordered, list)
+	}
+	sort.Strings(ordered)
+
+	for _, list := range ordered {
+		//lists can hold the same mod twice, so they are compared as counts
+		counts := make(map[string]int)
+		for _, id := range a.Lists[list] {
+			counts[id]--
+		}
+		for _, id := range b.Lists[list] {
+			counts[id]++
+		}
+		for _, id := range a.Lists[list] {
+			if counts[id] < 0 {
+				counts[id]++
+				changes = append(changes, Change{Type: "removed", Slot: name, Field: list, From: names(id)})
+			}
+		}
+		for _, id := range b.Lists[list] {
+			if counts[id] > 0 {
+				counts[id]--
+				changes = append(changes, Change{Type: "added", Slot: name, Field: list, To: names(id)})
+			}
+		}
+	}
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// buildByRef finds a stored build by its id, anything that isn't one is read as a share code
+func buildByRef(ref string) (diffSide, Class, error) {
+	stored, err := Builds.Find(ref)
+	if err == nil {
+		return diffSide{ID: stored.ID, Class: stored.Class, Name: stored.Build.Name}, stored.Build, nil
+	}
+	if !errors.Is(err, ErrBuildNotFound) {
+		return diffSide{}, Class{}, BuildHTTPError(err)
+	}
+
+	class, build, err := DecodeShareCode(ref)
+	if err != nil {
+		return diffSide{}, Class{}, functions.NotFound("No build or share code " + ref)
+	}
+	return diffSide{Class: class, Name: build.Name}, build, nil
+}
+
+// GetBuildsDiff compares the builds a and b, each given as a build id or a share code
+func GetBuildsDiff(w http.ResponseWriter, router *http.Request) {
+	query := router.URL.Query()
+	if query.Get("a") == "" || query.Get("b") == "" {
+		functions.WriteError(w, functions.BadRequest("Both a and b are needed"))
+		return
+	}
+
+	var diff BuildDiff
+	var a, b Class
+	var err error
+	if diff.A, a, err = buildByRef(query.Get("a")); err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	if diff.B, b, err = buildByRef(query.Get("b")); err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+
+	var hashes []Hash
+	for _, id := range append(a.Hashes(), b.Hashes()...) {
+		if hash, err := ParseHash(id); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	items, err := Manifest.Store(Language(router)).GetMany(itemTable, hashes)
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+
+	diff.Changes = DiffBuilds(a, b, func(id string) DiffItem {
+		item := DiffItem{Hash: id}
+		if hash, err := ParseHash(id); err == nil {
+			var definition struct {
+				DisplayProperties struct {
+					Name string `json:"name"`
+				} `json:"displayProperties"`
+			}
+			json.Unmarshal(items[hash], &definition)
+			item.Name = definition.DisplayProperties.Name
+		}
+		return item
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
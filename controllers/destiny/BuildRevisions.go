@@ -0,0 +1,219 @@
+package destiny
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrRevisionNotFound is returned for revision numbers a build doesn't have
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is an immutable snapshot of a build taken on every change, Deleted marks the change that removed it
+type Revision struct {
+	BuildID string    `json:"buildId"`
+	Number  int       `json:"revision"`
+	Class   string    `json:"class"`
+	Build   Class     `json:"build"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	Deleted bool      `json:"deleted"`
+}
+
+// migrateRevisions adds the revisions table to databases made before it, the builds already there
+// get a first revision so their history starts from what they are now
+func migrateRevisions(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS build_revisions (
+		build_id TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		class TEXT NOT NULL,
+		data TEXT NOT NULL,
+		author TEXT NOT NULL,
+		created TEXT NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (build_id, revision)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO build_revisions (build_id, revision, class, data, author, created)
+		SELECT id, 1, class, data, 'builds.json', updated FROM builds
+		WHERE id NOT IN (SELECT build_id FROM build_revisions)`)
+	return err
+}
+
+type queryExecer interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// recordRevision snapshots the build as the next revision, inside the transaction making the change
+func recordRevision(tx queryExecer, build StoredBuild, author string, deleted bool) error {
+	var last int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM build_revisions WHERE build_id = ?", build.ID).Scan(&last); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(build.Build)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO build_revisions (build_id, revision, class, data, author, created, deleted) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		build.ID, last+1, build.Class, string(data), author, build.Updated.Format(time.RFC3339Nano), deleted)
+	return err
+}
+
+func scanRevision(row scanner) (Revision, error) {
+	var revision Revision
+	var data, created string
+	if err := row.Scan(&revision.BuildID, &revision.Number, &revision.Class, &data, &revision.Author, &created, &revision.Deleted); err != nil {
+		return Revision{}, err
+	}
+	if err := json.Unmarshal([]byte(data), &revision.Build); err != nil {
+		return Revision{}, fmt.Errorf("revision %d of %s: %w", revision.Number, revision.BuildID, err)
+	}
+	revision.Created, _ = time.Parse(time.RFC3339Nano, created)
+	return revision, nil
+}
+
+const revisionColumns = "build_id, revision, class, data, author, created, deleted"
+
+// History lists every revision of a build, oldest first
+func (store *BuildStore) History(id string) ([]Revision, error) {
+	db, err := store.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT "+revisionColumns+" FROM build_revisions WHERE build_id = ? ORDER BY revision", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]Revision, 0)
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, ErrBuildNotFound
+	}
+	return revisions, nil
+}
+
+func (store *BuildStore) Revision(id string, number int) (Revision, error) {
+	db, err := store.conn()
+	if err != nil {
+		return Revision{}, err
+	}
+
+	revision, err := scanRevision(db.QueryRow("SELECT "+revisionColumns+" FROM build_revisions WHERE build_id = ? AND revision = ?", id, number))
+	if err == sql.ErrNoRows {
+		return Revision{}, ErrRevisionNotFound
+	}
+	return revision, err
+}
+
+// Rollback makes the build what it was at the given revision, recorded as a new revision.
+// A deleted build is brought back under its old id.
+func (store *BuildStore) Rollback(id string, number int, author string) (StoredBuild, error) {
+	revision, err := store.Revision(id, number)
+	if err != nil {
+		return StoredBuild{}, err
+	}
+	if revision.Deleted {
+		return StoredBuild{}, functions.BadRequest(fmt.Sprintf("Revision %d is the build being deleted, roll back to one before it", number))
+	}
+
+	stored, err := store.Update(revision.Class, id, revision.Build, author)
+	if errors.Is(err, ErrBuildNotFound) {
+		return store.createBuild(revision.Class, id, revision.Build, author)
+	}
+	return stored, err
+}
+
+// Author is who made a change, from the X-Author header or the author parameter
+func Author(router *http.Request) string {
+	author := strings.TrimSpace(router.Header.Get("X-Author"))
+	if author == "" {
+		author = strings.TrimSpace(router.URL.Query().Get("author"))
+	}
+	if author == "" {
+		return "anonymous"
+	}
+	return author
+}
+
+func revisionNumber(router *http.Request) (int, error) {
+	number, err := strconv.Atoi(mux.Vars(router)["n"])
+	if err != nil || number < 1 {
+		return 0, functions.BadRequest("The revision has to be a number from 1")
+	}
+	return number, nil
+}
+
+// RevisionHTTPError turns a revision lookup error into the error a handler answers with
+func RevisionHTTPError(err error) *functions.Error {
+	if errors.Is(err, ErrRevisionNotFound) {
+		return functions.NotFound("The build has no such revision")
+	}
+	if errors.Is(err, ErrBuildNotFound) {
+		return functions.NotFound("No build with this id")
+	}
+	return BuildHTTPError(err)
+}
+
+func GetBuildHistory(w http.ResponseWriter, router *http.Request) {
+	revisions, err := Builds.History(mux.Vars(router)["id"])
+	if err != nil {
+		functions.WriteError(w, RevisionHTTPError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func GetBuildRevision(w http.ResponseWriter, router *http.Request) {
+	number, err := revisionNumber(router)
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	revision, err := Builds.Revision(mux.Vars(router)["id"], number)
+	if err != nil {
+		functions.WriteError(w, RevisionHTTPError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
+}
+
+func PostBuildRollback(w http.ResponseWriter, router *http.Request) {
+	number, err := revisionNumber(router)
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	stored, err := Builds.Rollback(mux.Vars(router)["id"], number, Author(router))
+	if err != nil {
+		functions.WriteError(w, RevisionHTTPError(err))
+		return
+	}
+	writeBuild(w, http.StatusOK, stored)
+}
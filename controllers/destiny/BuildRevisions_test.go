@@ -0,0 +1,112 @@
+package destiny
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"projector/controllers/functions"
+	"testing"
+)
+
+func TestRollbackUpdate(t *testing.T) {
+	store := testBuilds(t)
+	created, err := store.Create("warlock", "", Class{Name: "Void"}, "ana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Update("warlock", created.ID, Class{Name: "Void 2"}, "ikora"); err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := store.Rollback(created.ID, 1, "osiris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled.ID != created.ID || rolled.Build.Name != "Void" {
+		t.Errorf("expected the first version back under %s, got %+v", created.ID, rolled)
+	}
+
+	history, err := store.History(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the rollback is a change of its own, the revision it went back past is kept
+	want := []struct {
+		name, author string
+	}{{"Void", "ana"}, {"Void 2", "ikora"}, {"Void", "osiris"}}
+	if len(history) != len(want) {
+		t.Fatalf("expected %d revisions, got %+v", len(want), history)
+	}
+	for i, revision := range history {
+		if revision.Number != i+1 || revision.Build.Name != want[i].name || revision.Author != want[i].author || revision.Deleted {
+			t.Errorf("revision %d: expected %s by %s, got %+v", i+1, want[i].name, want[i].author, revision)
+		}
+	}
+}
+
+func TestRollbackDeleted(t *testing.T) {
+	store := testBuilds(t)
+	created, err := store.Create("hunter", "", Class{Name: "Trapper"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("hunter", created.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("hunter", created.ID); !errors.Is(err, ErrBuildNotFound) {
+		t.Fatalf("expected the build to be gone, got %v", err)
+	}
+
+	//revision 2 is the delete itself, there is nothing to go back to in it
+	if _, err := store.Rollback(created.ID, 2, "test"); functions.AsError(err).Status != http.StatusBadRequest {
+		t.Errorf("expected the deleting revision to be refused, got %v", err)
+	}
+	if _, err := store.Rollback(created.ID, 3, "test"); !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("expected ErrRevisionNotFound past the last revision, got %v", err)
+	}
+
+	restored, err := store.Rollback(created.ID, 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("hunter", created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != created.ID || got.Build.Name != "Trapper" {
+		t.Errorf("expected the build back under %s, got %+v", created.ID, got)
+	}
+	if history, _ := store.History(created.ID); len(history) != 3 || history[2].Deleted {
+		t.Errorf("expected the restore as a third revision, got %+v", history)
+	}
+}
+
+func TestSeededBuildsHaveARevision(t *testing.T) {
+	store := testBuilds(t)
+	store.Seed = filepath.Join(t.TempDir(), "builds.json")
+	if err := ioutil.WriteFile(store.Seed, []byte(`{"warlock":[{"name":"Lazer tag"}],"titan":[{"name":"Bonk"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := 0
+	for _, list := range builds {
+		for _, build := range list {
+			seeded++
+			history, err := store.History(build.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 || history[0].Number != 1 || history[0].Author != "builds.json" || history[0].Build.Name != build.Build.Name {
+				t.Errorf("expected %q to start its history from the seed, got %+v", build.Build.Name, history)
+			}
+		}
+	}
+	if seeded != 2 {
+		t.Errorf("expected the two seeded builds, got %d", seeded)
+	}
+}
@@ -0,0 +1,416 @@
+package destiny
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"projector/controllers/functions"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrBuildNotFound is returned for ids the store doesn't have under the given class
+var ErrBuildNotFound = errors.New("build not found")
+
+// ErrBuildExists is returned when creating a build with an id that is already taken
+var ErrBuildExists = errors.New("a build with this id already exists")
+
+// ErrInvalidBuildID is returned for ids that aren't in the format the store hands out
+var ErrInvalidBuildID = errors.New("build ids are 16 lowercase hexadecimal characters")
+
+// BuildIDPattern is the format of build ids, routes that take a bare id match it so an id
+// can never be mistaken for a class or a word like export
+const BuildIDPattern = "[0-9a-f]{16}"
+
+var buildIDFormat = regexp.MustCompile("^" + BuildIDPattern + "$")
+
+// StoredBuild is a build together with what the store keeps about it
+type StoredBuild struct {
+	ID      string    `json:"id"`
+	Class   string    `json:"class"`
+	Build   Class     `json:"build"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// BuildStore keeps the builds in sqlite, the first run seeds it from builds.json
+type BuildStore struct {
+	Path string
+	Seed string
+
+	mu sync.Mutex
+	db *sql.DB
+}
+
+var Builds = &BuildStore{
+	Path: "./resources/builds.db",
+	Seed: "./resources/builds.json",
+}
+
+// conn opens the database, creating and seeding the builds table when it doesn't exist yet
+func (store *BuildStore) conn() (*sql.DB, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.db != nil {
+		return store.db, nil
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+store.Path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	//sqlite allows one writer at a time anyway
+	db.SetMaxOpenConns(1)
+
+	var exists int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'builds'").Scan(&exists)
+	if err == nil && exists == 0 {
+		err = store.create(db)
+	}
+	if err == nil {
+		err = migrateRevisions(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store.db = db
+	return db, nil
+}
+
+func (store *BuildStore) create(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE builds (
+		id TEXT PRIMARY KEY,
+		class TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created TEXT NOT NULL,
+		updated TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	if store.Seed != "" {
+		jsonData, err := ioutil.ReadFile(store.Seed)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var builds map[string][]Class
+			if err := json.Unmarshal(jsonData, &builds); err != nil {
+				return fmt.Errorf("unable to read %s: %w", store.Seed, err)
+			}
+			now := time.Now().UTC()
+			for class, list := range builds {
+				for _, build := range list {
+					if err := insertBuild(tx, StoredBuild{ID: newBuildID(), Class: class, Build: build, Created: now, Updated: now}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertBuild(db execer, build StoredBuild) error {
+	data, err := json.Marshal(build.Build)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO builds (id, class, data, created, updated) VALUES (?, ?, ?, ?, ?)",
+		build.ID, build.Class, string(data), build.Created.Format(time.RFC3339Nano), build.Updated.Format(time.RFC3339Nano))
+	return err
+}
+
+// newBuildID hands out a random id, it never changes once the build is stored
+func newBuildID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBuild(row scanner) (StoredBuild, error) {
+	var build StoredBuild
+	var data, created, updated string
+	if err := row.Scan(&build.ID, &build.Class, &data, &created, &updated); err != nil {
+		return StoredBuild{}, err
+	}
+	if err := json.Unmarshal([]byte(data), &build.Build); err != nil {
+		return StoredBuild{}, fmt.Errorf("build %s: %w", build.ID, err)
+	}
+	build.Created, _ = time.Parse(time.RFC3339Nano, created)
+	build.Updated, _ = time.Parse(time.RFC3339Nano, updated)
+	return build, nil
+}
+
+// List returns every build grouped by class, oldest first
+func (store *BuildStore) List() (map[string][]StoredBuild, error) {
+	db, err := store.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, class, data, created, updated FROM builds ORDER BY created, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builds := make(map[string][]StoredBuild)
+	for rows.Next() {
+		build, err := scanBuild(rows)
+		if err != nil {
+			return nil, err
+		}
+		builds[build.Class] = append(builds[build.Class], build)
+	}
+	return builds, rows.Err()
+}
+
+func (store *BuildStore) Get(class, id string) (StoredBuild, error) {
+	db, err := store.conn()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+
+	build, err := scanBuild(db.QueryRow("SELECT id, class, data, created, updated FROM builds WHERE class = ? AND id = ?", class, id))
+	if err == sql.ErrNoRows {
+		return StoredBuild{}, ErrBuildNotFound
+	}
+	return build, err
+}
+
+// Find looks a build up by its id alone
+func (store *BuildStore) Find(id string) (StoredBuild, error) {
+	db, err := store.conn()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+
+	build, err := scanBuild(db.QueryRow("SELECT id, class, data, created, updated FROM builds WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return StoredBuild{}, ErrBuildNotFound
+	}
+	return build, err
+}
+
+// Create stores a new build, an empty id gets one generated and any other has to match BuildIDPattern
+func (store *BuildStore) Create(class, id string, build Class, author string) (StoredBuild, error) {
+	if id == "" {
+		id = newBuildID()
+	}
+	if !buildIDFormat.MatchString(id) {
+		return StoredBuild{}, ErrInvalidBuildID
+	}
+	return store.createBuild(class, id, build, author)
+}
+
+// createBuild stores a build under an id that is already known to be usable, either checked by Create
+// or the one a deleted build had when a rollback brings it back
+func (store *BuildStore) createBuild(class, id string, build Class, author string) (StoredBuild, error) {
+	db, err := store.conn()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+	defer tx.Rollback()
+
+	var taken int
+	if err := tx.QueryRow("SELECT count(*) FROM builds WHERE id = ?", id).Scan(&taken); err != nil {
+		return StoredBuild{}, err
+	}
+	if taken > 0 {
+		return StoredBuild{}, ErrBuildExists
+	}
+
+	now := time.Now().UTC()
+	stored := StoredBuild{ID: id, Class: class, Build: build, Created: now, Updated: now}
+	if err := insertBuild(tx, stored); err != nil {
+		return StoredBuild{}, err
+	}
+	if err := recordRevision(tx, stored, author, false); err != nil {
+		return StoredBuild{}, err
+	}
+	return stored, tx.Commit()
+}
+
+// Update replaces the build, keeping its id and creation time
+func (store *BuildStore) Update(class, id string, build Class, author string) (StoredBuild, error) {
+	db, err := store.conn()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StoredBuild{}, err
+	}
+	defer tx.Rollback()
+
+	stored, err := scanBuild(tx.QueryRow("SELECT id, class, data, created, updated FROM builds WHERE class = ? AND id = ?", class, id))
+	if err == sql.ErrNoRows {
+		return StoredBuild{}, ErrBuildNotFound
+	}
+	if err != nil {
+		return StoredBuild{}, err
+	}
+
+	data, err := json.Marshal(build)
+	if err != nil {
+		return StoredBuild{}, err
+	}
+	stored.Build = build
+	stored.Updated = time.Now().UTC()
+	_, err = tx.Exec("UPDATE builds SET data = ?, updated = ? WHERE class = ? AND id = ?",
+		string(data), stored.Updated.Format(time.RFC3339Nano), class, id)
+	if err != nil {
+		return StoredBuild{}, err
+	}
+	if err := recordRevision(tx, stored, author, false); err != nil {
+		return StoredBuild{}, err
+	}
+	return stored, tx.Commit()
+}
+
+// Delete removes the build, its history stays so it can be rolled back
+func (store *BuildStore) Delete(class, id string, author string) error {
+	db, err := store.conn()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := scanBuild(tx.QueryRow("SELECT id, class, data, created, updated FROM builds WHERE class = ? AND id = ?", class, id))
+	if err == sql.ErrNoRows {
+		return ErrBuildNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM builds WHERE class = ? AND id = ?", class, id); err != nil {
+		return err
+	}
+	stored.Updated = time.Now().UTC()
+	if err := recordRevision(tx, stored, author, true); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BuildHTTPError turns a store error into the error a handler answers with
+func BuildHTTPError(err error) *functions.Error {
+	switch {
+	case errors.Is(err, ErrBuildNotFound):
+		return functions.NotFound("No build with this id for the class")
+	case errors.Is(err, ErrBuildExists):
+		return functions.NewError(http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, ErrInvalidBuildID):
+		return functions.BadRequest("Invalid build id, " + err.Error())
+	}
+	return functions.AsError(err)
+}
+
+// readBuild decodes and validates the build sent with a POST or PUT
+func readBuild(router *http.Request, class string) (Class, error) {
+	var build Class
+	if err := json.NewDecoder(router.Body).Decode(&build); err != nil {
+		return Class{}, functions.BadRequest("Unable to read the build: " + err.Error())
+	}
+	if err := validateBuild(class, build); err != nil {
+		return Class{}, err
+	}
+	return build, nil
+}
+
+func writeBuild(w http.ResponseWriter, status int, build StoredBuild) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(build)
+}
+
+func GetBuild(w http.ResponseWriter, router *http.Request) {
+	vars := mux.Vars(router)
+	stored, err := Builds.Get(vars["class"], vars["id"])
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	writeBuild(w, http.StatusOK, stored)
+}
+
+func PostBuild(w http.ResponseWriter, router *http.Request) {
+	vars := mux.Vars(router)
+	build, err := readBuild(router, vars["class"])
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+
+	stored, err := Builds.Create(vars["class"], vars["id"], build, Author(router))
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	writeBuild(w, http.StatusCreated, stored)
+}
+
+func PutBuild(w http.ResponseWriter, router *http.Request) {
+	vars := mux.Vars(router)
+	build, err := readBuild(router, vars["class"])
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+
+	stored, err := Builds.Update(vars["class"], vars["id"], build, Author(router))
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	writeBuild(w, http.StatusOK, stored)
+}
+
+func DeleteBuild(w http.ResponseWriter, router *http.Request) {
+	vars := mux.Vars(router)
+	if err := Builds.Delete(vars["class"], vars["id"], Author(router)); err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
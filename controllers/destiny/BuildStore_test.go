@@ -0,0 +1,52 @@
+package destiny
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCreateBuildIDs(t *testing.T) {
+	store := testBuilds(t)
+	build := Class{Name: "Sunbracers"}
+
+	generated, err := store.Create("warlock", "", build, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !buildIDFormat.MatchString(generated.ID) {
+		t.Errorf("generated id %q does not match %s", generated.ID, BuildIDPattern)
+	}
+
+	if _, err := store.Create("warlock", "0123456789abcdef", build, "test"); err != nil {
+		t.Errorf("a well formed id was refused: %v", err)
+	}
+	if _, err := store.Create("warlock", "0123456789abcdef", build, "test"); !errors.Is(err, ErrBuildExists) {
+		t.Errorf("expected ErrBuildExists for a taken id, got %v", err)
+	}
+
+	//words the id-only routes use must never become ids
+	for _, id := range []string{"export", "history", "plan", "share", "0123456789ABCDEF", "0123456789abcdef0"} {
+		if _, err := store.Create("warlock", id, build, "test"); !errors.Is(err, ErrInvalidBuildID) {
+			t.Errorf("expected id %q to be refused, got %v", id, err)
+		}
+	}
+}
+
+func TestPostBuildRefusesInvalidID(t *testing.T) {
+	testManifest(t, fixtureTables{itemTable: {}})
+	testBuilds(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/destiny/builds/{class}/{id}", PostBuild).Methods("POST")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/destiny/builds/warlock/export", strings.NewReader(`{"name":"Export"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for the id export, got %d: %s", w.Code, w.Body.String())
+	}
+}
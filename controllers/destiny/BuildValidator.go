@@ -0,0 +1,356 @@
+package destiny
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"projector/controllers/functions"
+	"sort"
+	"strings"
+)
+
+const socketTypeTable = "DestinySocketTypeDefinition"
+
+// SlotEquipment maps the slot keys of a build to the equipment slot their item has to go in
+var SlotEquipment = map[string]Hash{
+	"kinetic":     1498876634,
+	"energy":      2465295065,
+	"heavy":       953998645,
+	"helmet":      3448274439,
+	"gauntlets":   3551918588,
+	"chest_armor": 14239492,
+	"leg_armor":   20886954,
+	"class_armor": 1585787867,
+}
+
+// ArmorModCategories is the plug category of the mods only one armor piece takes,
+// mods of any other enhancements category fit every piece
+var ArmorModCategories = map[string]string{
+	"helmet":      "enhancements.v2_head",
+	"gauntlets":   "enhancements.v2_arms",
+	"chest_armor": "enhancements.v2_chest",
+	"leg_armor":   "enhancements.v2_legs",
+	"class_armor": "enhancements.v2_class_item",
+}
+
+// Problem is one thing wrong with a build, Slot is empty for the build as a whole
+type Problem struct {
+	Slot    string `json:"slot,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Message string `json:"message"`
+}
+
+type BuildReport struct {
+	ID       string    `json:"id,omitempty"`
+	Class    string    `json:"class"`
+	Name     string    `json:"name"`
+	Valid    bool      `json:"valid"`
+	Errors   []Problem `json:"errors"`
+	Warnings []Problem `json:"warnings"`
+}
+
+func (report *BuildReport) errorf(slot, hash, format string, args ...interface{}) {
+	report.Errors = append(report.Errors, Problem{Slot: slot, Hash: hash, Message: fmt.Sprintf(format, args...)})
+}
+
+func (report *BuildReport) warnf(slot, hash, format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, Problem{Slot: slot, Hash: hash, Message: fmt.Sprintf(format, args...)})
+}
+
+type ValidationReport struct {
+	Valid  bool          `json:"valid"`
+	Builds []BuildReport `json:"builds"`
+}
+
+// validationItem is the part of an item definition the validator looks at
+type validationItem struct {
+	DisplayProperties struct {
+		Name string `json:"name"`
+	} `json:"displayProperties"`
+	ClassType      int `json:"classType"`
+	EquippingBlock *struct {
+		EquipmentSlotTypeHash Hash `json:"equipmentSlotTypeHash"`
+	} `json:"equippingBlock"`
+	Plug *struct {
+		PlugCategoryIdentifier string `json:"plugCategoryIdentifier"`
+		EnergyCapacity         *struct {
+			CapacityValue int `json:"capacityValue"`
+		} `json:"energyCapacity"`
+	} `json:"plug"`
+	Sockets *struct {
+		SocketEntries []struct {
+			SocketTypeHash Hash `json:"socketTypeHash"`
+		} `json:"socketEntries"`
+	} `json:"sockets"`
+}
+
+func (item validationItem) category() string {
+	if item.Plug == nil {
+		return ""
+	}
+	return item.Plug.PlugCategoryIdentifier
+}
+
+// Validator checks builds against the definitions of one manifest store
+type Validator struct {
+	Store *ManifestStore
+}
+
+// Validate reports what is wrong with a build, the error is only set when the manifest couldn't be read
+func (validator Validator) Validate(class string, build Class) (BuildReport, error) {
+	report := BuildReport{Class: class, Name: build.Name, Errors: make([]Problem, 0), Warnings: make([]Problem, 0)}
+
+	classType, known := ClassTypes[class]
+	if !known {
+		report.errorf("", "", "Unknown class %q", class)
+	}
+
+	hashes := make(map[string]Hash)
+	var lookup []Hash
+	for _, id := range build.Hashes() {
+		if id == "" {
+			continue
+		}
+		hash, err := ParseHash(id)
+		if err != nil {
+			report.errorf("", id, "%v", err)
+			continue
+		}
+		hashes[id] = hash
+		lookup = append(lookup, hash)
+	}
+	raw, err := validator.Store.GetMany(itemTable, lookup)
+	if err != nil {
+		return report, err
+	}
+
+	items := make(map[string]validationItem, len(raw))
+	for id, hash := range hashes {
+		data, ok := raw[hash]
+		if !ok {
+			continue
+		}
+		var item validationItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			return report, &ManifestError{Table: itemTable, Hash: hash, Err: err}
+		}
+		items[id] = item
+	}
+
+	//looks the hash up, reporting it when it isn't in the manifest
+	get := func(slot, id string) (validationItem, bool) {
+		item, ok := items[id]
+		if !ok && hashes[id] != 0 {
+			report.errorf(slot, id, "Not in the destiny manifest")
+		}
+		return item, ok
+	}
+
+	if err := validator.checkSubclass(&report, class, classType, known, build.Subclass, get); err != nil {
+		return report, err
+	}
+
+	names := make([]string, 0, len(build.Slots))
+	for name := range build.Slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		slot := build.Slots[name]
+		equipment, checked := SlotEquipment[name]
+		if !checked {
+			report.warnf(name, "", "Unknown slot, its items are not checked")
+		}
+
+		if item, ok := get(name, slot.Item); ok && checked {
+			if item.EquippingBlock == nil || item.EquippingBlock.EquipmentSlotTypeHash != equipment {
+				report.errorf(name, slot.Item, "%s does not go in the %s slot", item.DisplayProperties.Name, name)
+			}
+			if known && item.ClassType != 3 && item.ClassType != classType {
+				report.errorf(name, slot.Item, "%s can't be worn by a %s", item.DisplayProperties.Name, class)
+			}
+		}
+
+		listNames := make([]string, 0, len(slot.Lists))
+		for list := range slot.Lists {
+			listNames = append(listNames, list)
+		}
+		sort.Strings(listNames)
+
+		for _, list := range listNames {
+			for _, id := range slot.Lists[list] {
+				plug, ok := get(name, id)
+				if !ok || !checked {
+					continue
+				}
+				category := plug.category()
+				if category == "" {
+					report.warnf(name, id, "%s in %s is not a plug", plug.DisplayProperties.Name, list)
+					continue
+				}
+
+				_, armor := ArmorModCategories[name]
+				isMod := strings.HasPrefix(category, "enhancements.")
+				switch {
+				case !armor && isMod:
+					report.errorf(name, id, "%s in %s is an armor mod", plug.DisplayProperties.Name, list)
+				case armor && !isMod:
+					report.errorf(name, id, "%s in %s is not an armor mod", plug.DisplayProperties.Name, list)
+				case armor && isPieceMod(category) && category != ArmorModCategories[name]:
+					report.errorf(name, id, "%s in %s belongs on another armor piece (%s)", plug.DisplayProperties.Name, list, category)
+				}
+			}
+		}
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report, nil
+}
+
+func isPieceMod(category string) bool {
+	for _, piece := range ArmorModCategories {
+		if category == piece {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSubclass looks at the subclass item, its aspect sockets and the fragment slots the aspects give
+func (validator Validator) checkSubclass(report *BuildReport, class string, classType int, known bool, slot Slot,
+	get func(slot, id string) (validationItem, bool)) error {
+	subclass, ok := get("subclass", slot.Item)
+	if ok && known && subclass.ClassType != classType {
+		report.errorf("subclass", slot.Item, "%s does not belong to the %s", subclass.DisplayProperties.Name, class)
+	}
+
+	aspects := slot.Lists["aspects"]
+	fragments := slot.Lists["fragments"]
+
+	capacity := 0
+	for _, id := range aspects {
+		if aspect, ok := get("subclass", id); ok {
+			if !strings.HasSuffix(aspect.category(), ".aspects") {
+				report.errorf("subclass", id, "%s is not an aspect", aspect.DisplayProperties.Name)
+			} else if aspect.Plug.EnergyCapacity != nil {
+				capacity += aspect.Plug.EnergyCapacity.CapacityValue
+			}
+		}
+	}
+	for _, id := range fragments {
+		if fragment, ok := get("subclass", id); ok && !strings.HasSuffix(fragment.category(), ".fragments") {
+			report.errorf("subclass", id, "%s is not a fragment", fragment.DisplayProperties.Name)
+		}
+	}
+	if len(aspects) > 0 && len(fragments) > capacity {
+		report.errorf("subclass", "", "%d fragments but the aspects only give %d fragment slots", len(fragments), capacity)
+	}
+
+	if !ok || len(aspects) == 0 {
+		return nil
+	}
+	if subclass.Sockets == nil {
+		report.warnf("subclass", slot.Item, "The subclass has no sockets to count the aspect slots from")
+		return nil
+	}
+
+	//the socket type of each subclass socket says which plug categories go in it
+	var socketTypes []Hash
+	for _, entry := range subclass.Sockets.SocketEntries {
+		socketTypes = append(socketTypes, entry.SocketTypeHash)
+	}
+	raw, err := validator.Store.GetMany(socketTypeTable, socketTypes)
+	if errors.Is(err, ErrUnknownTable) {
+		report.warnf("subclass", slot.Item, "Socket types are not in the manifest, the aspect slots are not counted")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	slots := 0
+	for _, hash := range socketTypes {
+		var socketType struct {
+			PlugWhitelist []struct {
+				CategoryIdentifier string `json:"categoryIdentifier"`
+			} `json:"plugWhitelist"`
+		}
+		if data, ok := raw[hash]; ok {
+			if err := json.Unmarshal(data, &socketType); err != nil {
+				return &ManifestError{Table: socketTypeTable, Hash: hash, Err: err}
+			}
+		}
+		for _, plug := range socketType.PlugWhitelist {
+			if strings.HasSuffix(plug.CategoryIdentifier, ".aspects") {
+				slots++
+				break
+			}
+		}
+	}
+	if len(aspects) > slots {
+		report.errorf("subclass", slot.Item, "%d aspects but %s only has %d aspect slots", len(aspects), subclass.DisplayProperties.Name, slots)
+	}
+	return nil
+}
+
+// ValidateBuilds reports on every stored build
+func ValidateBuilds(store *ManifestStore) (ValidationReport, error) {
+	builds, err := Builds.List()
+	if err != nil {
+		return ValidationReport{}, functions.Internal("Unable to read the builds", err)
+	}
+
+	classes := make([]string, 0, len(builds))
+	for class := range builds {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	validator := Validator{Store: store}
+	report := ValidationReport{Valid: true, Builds: make([]BuildReport, 0)}
+	for _, class := range classes {
+		for _, build := range builds[class] {
+			buildReport, err := validator.Validate(class, build.Build)
+			if err != nil {
+				return ValidationReport{}, ManifestHTTPError(err)
+			}
+			buildReport.ID = build.ID
+			report.Valid = report.Valid && buildReport.Valid
+			report.Builds = append(report.Builds, buildReport)
+		}
+	}
+	return report, nil
+}
+
+func GetBuildsValidation(w http.ResponseWriter, router *http.Request) {
+	report, err := ValidateBuilds(Manifest.Store(DefaultManifestLocale))
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// CheckBuildsOnStartup logs the problems of every stored build once the first manifest check is done
+func CheckBuildsOnStartup() {
+	go func() {
+		<-Manifest.Ready()
+		report, err := ValidateBuilds(Manifest.Store(DefaultManifestLocale))
+		if err != nil {
+			log.Println("Unable to validate the destiny builds:", err)
+			return
+		}
+		for _, build := range report.Builds {
+			for _, problem := range build.Errors {
+				log.Printf("Build %q (%s): error in %s %s: %s", build.Name, build.Class, problem.Slot, problem.Hash, problem.Message)
+			}
+			for _, problem := range build.Warnings {
+				log.Printf("Build %q (%s): warning in %s %s: %s", build.Name, build.Class, problem.Slot, problem.Hash, problem.Message)
+			}
+		}
+	}()
+}
@@ -0,0 +1,152 @@
+package destiny
+
+import (
+	"strings"
+	"testing"
+)
+
+// validatorManifest is a warlock void subclass with two aspect sockets, its aspects and fragments,
+// a couple of weapons and helmets and a mod for each kind of armor socket
+func validatorManifest(t *testing.T) *ManifestStore {
+	return testManifest(t, fixtureTables{
+		itemTable: {
+			100: `{"displayProperties":{"name":"Voidwalker"},"classType":2,"sockets":{"socketEntries":[{"socketTypeHash":500},{"socketTypeHash":500},{"socketTypeHash":501},{"socketTypeHash":501}]}}`,
+			101: `{"displayProperties":{"name":"Sentinel"},"classType":0}`,
+			200: `{"displayProperties":{"name":"Chaos Accelerant"},"plug":{"plugCategoryIdentifier":"warlock.void.aspects","energyCapacity":{"capacityValue":2}}}`,
+			201: `{"displayProperties":{"name":"Feed the Void"},"plug":{"plugCategoryIdentifier":"warlock.void.aspects","energyCapacity":{"capacityValue":1}}}`,
+			202: `{"displayProperties":{"name":"Child of the Old Gods"},"plug":{"plugCategoryIdentifier":"warlock.void.aspects","energyCapacity":{"capacityValue":2}}}`,
+			300: `{"displayProperties":{"name":"Echo of Expulsion"},"plug":{"plugCategoryIdentifier":"shared.void.fragments"}}`,
+			301: `{"displayProperties":{"name":"Echo of Provision"},"plug":{"plugCategoryIdentifier":"shared.void.fragments"}}`,
+			302: `{"displayProperties":{"name":"Echo of Persistence"},"plug":{"plugCategoryIdentifier":"shared.void.fragments"}}`,
+			303: `{"displayProperties":{"name":"Echo of Undermining"},"plug":{"plugCategoryIdentifier":"shared.void.fragments"}}`,
+			400: `{"displayProperties":{"name":"Funnelweb"},"classType":3,"equippingBlock":{"equipmentSlotTypeHash":1498876634}}`,
+			401: `{"displayProperties":{"name":"Gjallarhorn"},"classType":3,"equippingBlock":{"equipmentSlotTypeHash":953998645}}`,
+			402: `{"displayProperties":{"name":"Frenzy"},"plug":{"plugCategoryIdentifier":"frames"}}`,
+			410: `{"displayProperties":{"name":"Nezarec's Sin"},"classType":2,"equippingBlock":{"equipmentSlotTypeHash":3448274439}}`,
+			411: `{"displayProperties":{"name":"Helm of Saint-14"},"classType":0,"equippingBlock":{"equipmentSlotTypeHash":3448274439}}`,
+			420: `{"displayProperties":{"name":"Heavy Ammo Finder"},"plug":{"plugCategoryIdentifier":"enhancements.v2_head"}}`,
+			421: `{"displayProperties":{"name":"Grenade Kickstart"},"plug":{"plugCategoryIdentifier":"enhancements.v2_arms"}}`,
+			422: `{"displayProperties":{"name":"Discipline Mod"},"plug":{"plugCategoryIdentifier":"enhancements.v2_general"}}`,
+		},
+		socketTypeTable: {
+			500: `{"plugWhitelist":[{"categoryIdentifier":"warlock.void.aspects"}]}`,
+			501: `{"plugWhitelist":[{"categoryIdentifier":"shared.void.fragments"}]}`,
+		},
+	}).Store(DefaultManifestLocale)
+}
+
+func TestValidate(t *testing.T) {
+	validator := Validator{Store: validatorManifest(t)}
+
+	tests := []struct {
+		name  string
+		class string
+		build string
+		slot  string
+		error string
+	}{
+		{
+			name:  "valid",
+			class: "warlock",
+			build: `{"name":"Void","subclass":{"item":"100","aspects":["200","201"],"fragments":["300","301","302"]},
+				"kinetic":{"item":"400","recomended_perks":["402"]},"helmet":{"item":"410","recomended_mods":["420","422"]}}`,
+		},
+		{
+			name:  "wrong equipment slot",
+			class: "warlock",
+			build: `{"name":"Void","kinetic":{"item":"401"}}`,
+			slot:  "kinetic",
+			error: "Gjallarhorn does not go in the kinetic slot",
+		},
+		{
+			name:  "wrong class",
+			class: "warlock",
+			build: `{"name":"Void","helmet":{"item":"411"}}`,
+			slot:  "helmet",
+			error: "Helm of Saint-14 can't be worn by a warlock",
+		},
+		{
+			name:  "subclass of another class",
+			class: "warlock",
+			build: `{"name":"Void","subclass":{"item":"101"}}`,
+			slot:  "subclass",
+			error: "Sentinel does not belong to the warlock",
+		},
+		{
+			name:  "mod on the wrong armor piece",
+			class: "warlock",
+			build: `{"name":"Void","helmet":{"item":"410","recomended_mods":["421"]}}`,
+			slot:  "helmet",
+			error: "Grenade Kickstart in recomended_mods belongs on another armor piece",
+		},
+		{
+			name:  "armor mod on a weapon",
+			class: "warlock",
+			build: `{"name":"Void","kinetic":{"item":"400","recomended_perks":["420"]}}`,
+			slot:  "kinetic",
+			error: "Heavy Ammo Finder in recomended_perks is an armor mod",
+		},
+		{
+			name:  "too many aspects",
+			class: "warlock",
+			build: `{"name":"Void","subclass":{"item":"100","aspects":["200","201","202"]}}`,
+			slot:  "subclass",
+			error: "3 aspects but Voidwalker only has 2 aspect slots",
+		},
+		{
+			name:  "fragments beyond the aspect capacity",
+			class: "warlock",
+			build: `{"name":"Void","subclass":{"item":"100","aspects":["200","201"],"fragments":["300","301","302","303"]}}`,
+			slot:  "subclass",
+			error: "4 fragments but the aspects only give 3 fragment slots",
+		},
+		{
+			name:  "hash missing from the manifest",
+			class: "warlock",
+			build: `{"name":"Void","kinetic":{"item":"999"}}`,
+			slot:  "kinetic",
+			error: "Not in the destiny manifest",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := validator.Validate(test.class, fixtureBuild(t, test.build))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.error == "" {
+				if !report.Valid || len(report.Errors) > 0 {
+					t.Errorf("expected a valid build, got %+v", report.Errors)
+				}
+				return
+			}
+
+			if report.Valid {
+				t.Errorf("expected the build to be invalid")
+			}
+			for _, problem := range report.Errors {
+				if problem.Slot == test.slot && strings.Contains(problem.Message, test.error) {
+					return
+				}
+			}
+			t.Errorf("expected %q in %s, got %+v", test.error, test.slot, report.Errors)
+		})
+	}
+}
+
+func TestValidateWithoutSocketTypes(t *testing.T) {
+	store := testManifest(t, fixtureTables{itemTable: {
+		100: `{"displayProperties":{"name":"Voidwalker"},"classType":2,"sockets":{"socketEntries":[{"socketTypeHash":500}]}}`,
+		200: `{"displayProperties":{"name":"Chaos Accelerant"},"plug":{"plugCategoryIdentifier":"warlock.void.aspects","energyCapacity":{"capacityValue":2}}}`,
+	}}).Store(DefaultManifestLocale)
+
+	report, err := Validator{Store: store}.Validate("warlock", fixtureBuild(t, `{"name":"Void","subclass":{"item":"100","aspects":["200"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || len(report.Warnings) != 1 {
+		t.Errorf("expected a valid build with a warning about the socket types, got %+v", report)
+	}
+}
@@ -2,319 +2,406 @@ package destiny
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"net/http"
-	"os"
+	"projector/controllers/functions"
+	"sort"
+	"strings"
 	//"strconv"
 )
 
-type Class struct {
-	Name       string   `json:"name"`
-	Preference []string `json:"preference"`
-	Subclass   struct {
-		Item      string        `json:"item"`
-		Aspects   []interface{} `json:"aspects"`
-		Fragments []interface{} `json:"fragments"`
-	} `json:"subclass"`
-	Kinetic struct {
-		Item            string        `json:"item"`
-		RecomendedPerks []interface{} `json:"recomended_perks"`
-	} `json:"kinetic"`
-	Energy struct {
-		Item            string        `json:"item"`
-		RecomendedPerks []interface{} `json:"recomended_perks"`
-	} `json:"energy"`
-	Heavy struct {
-		Item            string        `json:"item"`
-		RecomendedPerks []interface{} `json:"recomended_perks"`
-	} `json:"heavy"`
-	Helmet struct {
-		Item           string   `json:"item"`
-		RecomendedMods []string `json:"recomended_mods"`
-		OptionalMods   []string `json:"optional_mods"`
-	} `json:"helmet"`
-	Gauntlets struct {
-		Item           string   `json:"item"`
-		RecomendedMods []string `json:"recomended_mods"`
-		OptionalMods   []string `json:"optional_mods"`
-	} `json:"gauntlets"`
-	ChestArmor struct {
-		Item           string        `json:"item"`
-		RecomendedMods []string      `json:"recomended_mods"`
-		OptionalMods   []interface{} `json:"optional_mods"`
-	} `json:"chest_armor"`
-	LegArmor struct {
-		Item           string        `json:"item"`
-		RecomendedMods []string      `json:"recomended_mods"`
-		OptionalMods   []interface{} `json:"optional_mods"`
-	} `json:"leg_armor"`
-	ClassArmor struct {
-		Item           string   `json:"item"`
-		RecomendedMods []string `json:"recomended_mods"`
-		OptionalMods   []string `json:"optional_mods"`
-	} `json:"class_armor"`
+// Slot is one piece of a build, an item plus named lists of hashes such as recomended_perks or optional_mods.
+// In json the lists sit next to the item, {"item": "...", "recomended_mods": [...]}
+type Slot struct {
+	Item  string
+	Lists map[string][]string
 }
 
-func GetBuilds(w http.ResponseWriter, router *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	jsonFile, err := os.Open("./resources/builds.json")
-	if err != nil {
-		m := Message{Response: "Unable to open file"}
-		json.NewEncoder(w).Encode(m)
-		return
+func (slot *Slot) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
 	}
-	defer jsonFile.Close()
 
-	jsonData, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		m := Message{Response: "Unable to read file"}
-		json.NewEncoder(w).Encode(m)
-		return
-	}
-	var builds map[string][]Class
-	err2 := json.Unmarshal(jsonData, &builds)
-	if err2 != nil {
-		m := Message{Response: "Unable to read json data"}
-		json.NewEncoder(w).Encode(m)
-		return
+	*slot = Slot{Lists: make(map[string][]string)}
+	for key, value := range fields {
+		if key == "item" {
+			if err := json.Unmarshal(value, &slot.Item); err != nil {
+				return fmt.Errorf("slot item: %w", err)
+			}
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(value, &list); err != nil {
+			return fmt.Errorf("slot list %s: %w", key, err)
+		}
+		slot.Lists[key] = list
 	}
+	return nil
+}
 
-	buildsData := make(map[string]interface{})
-	buildsData["warlock"] = perChar(builds["warlock"])
-	//buildsData["hunter"] = perChar(builds["hunter"])
-	//buildsData["titan"] = perChar(builds["titan"])
-
-	json.NewEncoder(w).Encode(buildsData)
-
+func (slot Slot) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(slot.Lists)+1)
+	for key, list := range slot.Lists {
+		if list == nil {
+			list = []string{}
+		}
+		fields[key] = list
+	}
+	fields["item"] = slot.Item
+	return json.Marshal(fields)
 }
 
-func perChar(builds []Class) []interface{} {
-	var buildsData []interface{}
-	for _, build := range builds {
-		buildData := make(map[string]interface{})
+// Hashes lists the item and every hash of the slot's lists
+func (slot Slot) Hashes() []string {
+	ids := []string{slot.Item}
+	for _, list := range slot.Lists {
+		ids = append(ids, list...)
+	}
+	return ids
+}
 
-		//General
-		buildData["name"] = build.Name
-		buildData["preference"] = build.Preference
+// Class is a single build, every key of its json besides name, preference and subclass is a slot,
+// so new slots like an exotic class item or the artifact only need adding to builds.json
+type Class struct {
+	Name       string
+	Preference []string
+	Subclass   Slot
+	Slots      map[string]Slot
+}
 
-		//subclass
-		manifestItemData := make(map[string]interface{})
+func (build *Class) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
 
-		if build.Subclass.Item != "" {
-			_, data := DestinyManifestQuery(build.Subclass.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+	*build = Class{Slots: make(map[string]Slot)}
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "name":
+			err = json.Unmarshal(value, &build.Name)
+		case "preference":
+			err = json.Unmarshal(value, &build.Preference)
+		case "subclass":
+			err = json.Unmarshal(value, &build.Subclass)
+		default:
+			var slot Slot
+			err = json.Unmarshal(value, &slot)
+			build.Slots[key] = slot
 		}
-
-		//Subclass aspects
-		aspects := make([]Item, 0)
-		for _, id := range build.Subclass.Aspects {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			aspects = append(aspects, data)
+		if err != nil {
+			return fmt.Errorf("build %s: %w", key, err)
 		}
-		manifestItemData["aspects"] = aspects
+	}
+	return nil
+}
 
-		//Subclass fragments
-		fragments := make([]Item, 0)
-		for _, id := range build.Subclass.Fragments {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			fragments = append(fragments, data)
-		}
-		manifestItemData["fragments"] = fragments
+func (build Class) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(build.Slots)+3)
+	for key, slot := range build.Slots {
+		fields[key] = slot
+	}
+	fields["name"] = build.Name
+	fields["preference"] = build.Preference
+	fields["subclass"] = build.Subclass
+	return json.Marshal(fields)
+}
 
-		//Adding it to object
-		buildData["subclass"] = manifestItemData
+func GetBuilds(w http.ResponseWriter, router *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	builds, err := Builds.List()
+	if err != nil {
+		functions.WriteError(w, functions.Internal("Unable to read the builds", err))
+		return
+	}
 
-		//Primary
-		manifestItemData = make(map[string]interface{})
-		if build.Kinetic.Item != "" {
-			_, data := DestinyManifestQuery(build.Kinetic.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+	classes, err := classFilter(router, builds)
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	name := strings.ToLower(strings.TrimSpace(router.URL.Query().Get("name")))
+
+	selected := make(map[string][]StoredBuild, len(classes))
+	for _, class := range classes {
+		selected[class] = make([]StoredBuild, 0, len(builds[class]))
+		for _, build := range builds[class] {
+			if name == "" || strings.Contains(strings.ToLower(build.Build.Name), name) {
+				selected[class] = append(selected[class], build)
+			}
 		}
+	}
 
-		//Recomended perks for kinetic
-		recomended_perks := make([]Item, 0)
-		for _, id := range build.Kinetic.RecomendedPerks {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			recomended_perks = append(recomended_perks, data)
+	//every item of the returned builds is fetched up front in one batch
+	var ids []string
+	for _, class := range classes {
+		for _, build := range selected[class] {
+			ids = append(ids, build.Build.Hashes()...)
 		}
-		manifestItemData["recomended_perks"] = recomended_perks
-
-		//Adding it to object
-		buildData["kinetic"] = manifestItemData
+	}
+	items, err := newItemResolver(Manifest.Store(Language(router)), ids, ParseFields(router))
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
 
-		//Energy
-		manifestItemData = make(map[string]interface{})
-		if build.Energy.Item != "" {
-			_, data := DestinyManifestQuery(build.Energy.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+	buildsData := make(map[string]interface{}, len(classes))
+	for _, class := range classes {
+		buildsData[class], err = perChar(class, selected[class], items)
+		if err != nil {
+			functions.WriteError(w, err)
+			return
 		}
+	}
 
-		//Recomended perks for energy
-		recomended_perks = make([]Item, 0)
-		for _, id := range build.Energy.RecomendedPerks {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			recomended_perks = append(recomended_perks, data)
-		}
-		manifestItemData["recomended_perks"] = recomended_perks
+	json.NewEncoder(w).Encode(buildsData)
 
-		//Adding it to object
-		buildData["energy"] = manifestItemData
+}
 
-		//Heavy
-		manifestItemData = make(map[string]interface{})
-		if build.Heavy.Item != "" {
-			_, data := DestinyManifestQuery(build.Heavy.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
-		}
+// ClassTypes maps the class keys of builds.json to the classType the manifest gives their items
+var ClassTypes = map[string]int{
+	"titan":   0,
+	"hunter":  1,
+	"warlock": 2,
+}
 
-		//Recomended perks for energy
-		recomended_perks = make([]Item, 0)
-		for _, id := range build.Heavy.RecomendedPerks {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			recomended_perks = append(recomended_perks, data)
-		}
-		manifestItemData["recomended_perks"] = recomended_perks
+func checkClass(class string) error {
+	if _, ok := ClassTypes[class]; !ok {
+		return functions.BadRequest(fmt.Sprintf("Unknown class %q, expected titan, hunter or warlock", class))
+	}
+	return nil
+}
 
-		//Adding it to object
-		buildData["heavy"] = manifestItemData
+// validateBuild checks a build sent by a client, every hash it refers to has to be in the manifest
+func validateBuild(class string, build Class) error {
+	if err := checkClass(class); err != nil {
+		return err
+	}
+	if strings.TrimSpace(build.Name) == "" {
+		return functions.BadRequest("The build needs a name")
+	}
 
-		//Helmet
-		manifestItemData = make(map[string]interface{})
-		if build.Helmet.Item != "" {
-			_, data := DestinyManifestQuery(build.Helmet.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+	items, err := newItemResolver(Manifest.Store(DefaultManifestLocale), build.Hashes(), nil)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, id := range build.Hashes() {
+		hash, _ := ParseHash(id)
+		if _, ok := items.items[hash]; id != "" && !ok {
+			missing = append(missing, id)
 		}
+	}
+	if len(missing) > 0 {
+		return functions.BadRequest("Not in the destiny manifest: " + strings.Join(missing, ", "))
+	}
 
-		//Helmet recomended mods
-		var recomended_mods []Item
-		for _, id := range build.Helmet.RecomendedMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			recomended_mods = append(recomended_mods, data)
+	if err := items.checkSubclass(class, build); err != nil {
+		if e := functions.AsError(err); e.Code == "invalid_build" {
+			//the client sent the wrong subclass, nothing is broken on our side
+			return functions.BadRequest(e.Message)
 		}
-		manifestItemData["recomended_mods"] = recomended_mods
+		return err
+	}
+	return nil
+}
 
-		//Helmet optional mods
-		var optional_mods []Item
-		for _, id := range build.Helmet.OptionalMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			optional_mods = append(optional_mods, data)
+// classFilter reads the comma separated class parameter, without it every class in builds.json is returned
+func classFilter(router *http.Request, builds map[string][]StoredBuild) ([]string, error) {
+	var classes []string
+	if param := router.URL.Query().Get("class"); param != "" {
+		for _, class := range strings.Split(param, ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			if class == "" {
+				continue
+			}
+			if err := checkClass(class); err != nil {
+				return nil, err
+			}
+			classes = append(classes, class)
 		}
-		manifestItemData["optional_mods"] = optional_mods
-
-		//Adding it to object
-		buildData["helmet"] = manifestItemData
+		return classes, nil
+	}
 
-		//Gauntlet
-		manifestItemData = make(map[string]interface{})
-		if build.Gauntlets.Item != "" {
+	for class := range builds {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes, nil
+}
 
-			_, data := DestinyManifestQuery(build.Gauntlets.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+func perChar(class string, builds []StoredBuild, items *itemResolver) ([]interface{}, error) {
+	buildsData := make([]interface{}, 0, len(builds))
+	for _, stored := range builds {
+		buildData, err := items.resolveBuild(stored.Build)
+		if err != nil {
+			return nil, err
 		}
-
-		//Gauntlet recomended mods
-		recomended_mods = make([]Item, 0)
-		for _, id := range build.Gauntlets.RecomendedMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			recomended_mods = append(recomended_mods, data)
+		//a build with another class's subclass is served with what's wrong with it, the other builds still load
+		if err := items.checkSubclass(class, stored.Build); err != nil {
+			e := functions.AsError(err)
+			if e.Code != "invalid_build" {
+				return nil, err
+			}
+			buildData["errors"] = []string{e.Message}
 		}
-		manifestItemData["recomended_mods"] = recomended_mods
+		buildData["id"] = stored.ID
+		buildData["created"] = stored.Created
+		buildData["updated"] = stored.Updated
 
-		//Gauntlet optional mods
-		optional_mods = make([]Item, 0)
-		for _, id := range build.Gauntlets.OptionalMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			optional_mods = append(optional_mods, data)
-		}
-		manifestItemData["optional_mods"] = optional_mods
+		buildsData = append(buildsData, buildData)
+	}
 
-		//Adding it to object
-		buildData["gauntlets"] = manifestItemData
+	return buildsData, nil
+}
 
-		//Chest armor
-		manifestItemData = make(map[string]interface{})
-		if build.ChestArmor.Item != "" {
+// Hashes lists every item the build refers to
+func (build Class) Hashes() []string {
+	ids := build.Subclass.Hashes()
+	for _, slot := range build.Slots {
+		ids = append(ids, slot.Hashes()...)
+	}
+	return ids
+}
 
-			_, data := DestinyManifestQuery(build.ChestArmor.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
-		}
+// itemResolver holds every item a response needs, fetched in one batch instead of a query per item
+type itemResolver struct {
+	store  *ManifestStore
+	items  map[Hash]json.RawMessage
+	fields []string
+}
 
-		//Chest armor recomended mods
-		recomended_mods = make([]Item, 0)
-		for _, id := range build.ChestArmor.RecomendedMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			recomended_mods = append(recomended_mods, data)
+func newItemResolver(store *ManifestStore, ids []string, fields []string) (*itemResolver, error) {
+	seen := make(map[Hash]bool, len(ids))
+	var hashes []Hash
+	for _, id := range ids {
+		if id == "" {
+			continue
 		}
-		manifestItemData["recomended_mods"] = recomended_mods
-
-		//Chest armor optional mods
-		optional_mods = make([]Item, 0)
-		for _, id := range build.ChestArmor.OptionalMods {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			optional_mods = append(optional_mods, data)
+		hash, err := ParseHash(id)
+		if err != nil {
+			return nil, functions.BadRequest(err.Error())
 		}
-		manifestItemData["optional_mods"] = optional_mods
-
-		//Adding it to object
-		buildData["chest_armor"] = manifestItemData
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
 
-		//Leg armor
-		manifestItemData = make(map[string]interface{})
+	items, err := store.GetMany(itemTable, hashes)
+	if err != nil {
+		return nil, ManifestHTTPError(err)
+	}
+	return &itemResolver{store: store, items: items, fields: fields}, nil
+}
 
-		if build.LegArmor.Item != "" {
-			_, data := DestinyManifestQuery(build.LegArmor.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
-		}
+// checkSubclass makes sure the build's subclass belongs to the class it is listed under.
+// Subclasses missing from the manifest are left alone like every other missing item.
+func (resolver *itemResolver) checkSubclass(class string, build Class) error {
+	classType, ok := ClassTypes[class]
+	if !ok {
+		return functions.NewError(http.StatusInternalServerError, "invalid_build", fmt.Sprintf("builds.json lists the unknown class %q", class))
+	}
+	if build.Subclass.Item == "" {
+		return nil
+	}
 
-		//Leg armor recomended mods
-		recomended_mods = make([]Item, 0)
-		for _, id := range build.LegArmor.RecomendedMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			recomended_mods = append(recomended_mods, data)
-		}
-		manifestItemData["recomended_mods"] = recomended_mods
+	hash, err := ParseHash(build.Subclass.Item)
+	if err != nil {
+		return functions.BadRequest(err.Error())
+	}
+	raw, ok := resolver.items[hash]
+	if !ok {
+		return nil
+	}
+	var subclass struct {
+		ClassType int `json:"classType"`
+	}
+	if err := json.Unmarshal(raw, &subclass); err != nil {
+		return functions.Internal("Unable to read the destiny manifest", err)
+	}
+	if subclass.ClassType != classType {
+		return functions.NewError(http.StatusInternalServerError, "invalid_build",
+			fmt.Sprintf("The %s build %q uses subclass %s which does not belong to the %s", class, build.Name, hash, class))
+	}
+	return nil
+}
 
-		//Leg armor optional mods
-		optional_mods = make([]Item, 0)
-		for _, id := range build.LegArmor.OptionalMods {
-			_, data := DestinyManifestQuery(id.(string), "DestinyInventoryItemDefinition")
-			optional_mods = append(optional_mods, data)
-		}
-		manifestItemData["optional_mods"] = optional_mods
+// resolveBuild resolves the subclass and every slot of a build
+func (resolver *itemResolver) resolveBuild(build Class) (map[string]interface{}, error) {
+	buildData := make(map[string]interface{})
 
-		//Adding it to object
-		buildData["leg_armor"] = manifestItemData
+	//General
+	buildData["name"] = build.Name
+	buildData["preference"] = build.Preference
 
-		//Class armor
-		manifestItemData = make(map[string]interface{})
+	subclass, err := resolver.resolveSlot(build.Subclass)
+	if err != nil {
+		return nil, err
+	}
+	buildData["subclass"] = subclass
 
-		if build.ClassArmor.Item != "" {
-			_, data := DestinyManifestQuery(build.ClassArmor.Item, "DestinyInventoryItemDefinition")
-			manifestItemData["item"] = data
+	for name, slot := range build.Slots {
+		slotData, err := resolver.resolveSlot(slot)
+		if err != nil {
+			return nil, err
 		}
+		buildData[name] = slotData
+	}
+	return buildData, nil
+}
 
-		//Class armor recomended mods
-		recomended_mods = make([]Item, 0)
-		for _, id := range build.ClassArmor.RecomendedMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			recomended_mods = append(recomended_mods, data)
+// resolveSlot resolves the slot's item and every hash of its lists
+func (resolver *itemResolver) resolveSlot(slot Slot) (map[string]interface{}, error) {
+	slotData := make(map[string]interface{}, len(slot.Lists)+1)
+	if slot.Item != "" {
+		data, err := resolver.resolve(slot.Item)
+		if err != nil {
+			return nil, err
 		}
-		manifestItemData["recomended_mods"] = recomended_mods
+		slotData["item"] = data
+	}
 
-		//Class armor optional mods
-		optional_mods = make([]Item, 0)
-		for _, id := range build.ClassArmor.OptionalMods {
-			_, data := DestinyManifestQuery(id, "DestinyInventoryItemDefinition")
-			optional_mods = append(optional_mods, data)
+	for name, list := range slot.Lists {
+		resolved := make([]interface{}, 0, len(list))
+		for _, id := range list {
+			data, err := resolver.resolve(id)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, data)
 		}
-		manifestItemData["optional_mods"] = optional_mods
+		slotData[name] = resolved
+	}
+	return slotData, nil
+}
 
-		//Adding it to object
-		buildData["class_armor"] = manifestItemData
+// resolve returns an item decoded as an Item or projected down to the requested fields.
+// Items missing from the manifest come back empty so one stale hash doesn't take down the whole build.
+func (resolver *itemResolver) resolve(id string) (interface{}, error) {
+	hash, err := ParseHash(id)
+	if err != nil {
+		return nil, functions.BadRequest(err.Error())
+	}
+	raw := resolver.items[hash]
 
-		//Putting it all together in an object
-		buildsData = append(buildsData, buildData)
+	if len(resolver.fields) > 0 {
+		projected, err := ProjectFields(raw, resolver.fields)
+		if err != nil {
+			return nil, functions.Internal("Unable to read the destiny manifest", err)
+		}
+		return projected, nil
 	}
 
-	return buildsData
+	if raw == nil {
+		return Item{}, nil
+	}
+	//the decoded item is cached next to its json, so builds that rarely change are not unmarshalled again
+	item, err := resolver.store.decodeItem(hash, raw)
+	if err != nil {
+		return nil, functions.Internal("Unable to read the destiny manifest", err)
+	}
+	return item, nil
 }
@@ -0,0 +1,202 @@
+package destiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syntheticBuilds fills a manifest with a few thousand items and stores builds per class that
+// reference about forty of them each, roughly the shape of builds.json once it is filled in
+func syntheticBuilds(b *testing.B, perClass int) map[string][]StoredBuild {
+	b.Helper()
+	const firstItem, items = 1000, 3000
+
+	rows := make(map[Hash]string, items+len(ClassTypes))
+	for class, classType := range ClassTypes {
+		rows[Hash(10+classType)] = fmt.Sprintf(`{"displayProperties":{"name":"%s subclass"},"classType":%d,"itemType":16}`, class, classType)
+	}
+	for i := 0; i < items; i++ {
+		rows[Hash(firstItem+i)] = fmt.Sprintf(`{"displayProperties":{"name":"Item %d","description":"%s"},"classType":3,"itemType":3}`,
+			i, strings.Repeat("Lorem ipsum dolor sit amet. ", 8))
+	}
+	testManifest(b, fixtureTables{itemTable: rows})
+	store := testBuilds(b)
+
+	next := firstItem
+	hashes := func(n int) string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("%q", Hash(firstItem+(next-firstItem)%items).String())
+			next++
+		}
+		return strings.Join(ids, ",")
+	}
+
+	for class, classType := range ClassTypes {
+		for i := 0; i < perClass; i++ {
+			data := fmt.Sprintf(`{"name":"%s %d","preference":["Discipline","Recovery"],"subclass":{"item":"%d","aspects":[%s],"fragments":[%s]}`,
+				class, i, 10+classType, hashes(2), hashes(4))
+			for _, slot := range []string{"kinetic", "energy", "heavy"} {
+				data += fmt.Sprintf(`,%q:{"item":%s,"recomended_perks":[%s]}`, slot, hashes(1), hashes(4))
+			}
+			for _, slot := range ArmorSlots {
+				data += fmt.Sprintf(`,%q:{"item":%s,"recomended_mods":[%s]}`, slot, hashes(1), hashes(3))
+			}
+			if _, err := store.Create(class, "", fixtureBuild(b, data+"}"), "benchmark"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	builds, err := store.List()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return builds
+}
+
+// BenchmarkGetBuilds compares resolving every build with one batched query against a query per
+// item, with and without opening the database for each lookup the way the manifest used to be read
+func BenchmarkGetBuilds(b *testing.B) {
+	builds := syntheticBuilds(b, 20)
+	path, tables := Manifest.Path(DefaultManifestLocale), Manifest.Tables
+
+	var ids []string
+	for _, list := range builds {
+		for _, build := range list {
+			ids = append(ids, build.Build.Hashes()...)
+		}
+	}
+	b.Logf("%d builds referencing %d items", len(builds)*len(builds["titan"]), len(ids))
+
+	b.Run("batched", func(b *testing.B) {
+		//no cache, every iteration reads the database like a first request
+		store := NewManifestStore(path, DefaultManifestLocale, tables)
+		defer store.Close()
+		for i := 0; i < b.N; i++ {
+			items, err := newItemResolver(store, ids, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for class, list := range builds {
+				if _, err := perChar(class, list, items); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	lookup := func(b *testing.B, store *ManifestStore, id string) {
+		hash, _ := ParseHash(id)
+		raw, err := store.GetRaw(itemTable, hash)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var item Item
+		if err := json.Unmarshal(raw, &item); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("per-item", func(b *testing.B) {
+		store := NewManifestStore(path, DefaultManifestLocale, tables)
+		defer store.Close()
+		for i := 0; i < b.N; i++ {
+			for _, id := range ids {
+				lookup(b, store, id)
+			}
+		}
+	})
+
+	b.Run("per-item-open", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, id := range ids {
+				store := NewManifestStore(path, DefaultManifestLocale, tables)
+				lookup(b, store, id)
+				store.Close()
+			}
+		}
+	})
+
+	b.Run("handler", func(b *testing.B) {
+		//the real endpoint, served from the definition cache after the first request
+		for i := 0; i < b.N; i++ {
+			w := httptest.NewRecorder()
+			GetBuilds(w, httptest.NewRequest("GET", "/api/destiny/builds/", nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestGetBuildsServesMismatchedSubclass(t *testing.T) {
+	testManifest(t, fixtureTables{itemTable: {
+		100: `{"displayProperties":{"name":"Stormcaller"},"classType":2}`,
+		101: `{"displayProperties":{"name":"Nightstalker"},"classType":1}`,
+	}})
+	store := testBuilds(t)
+	for class, data := range map[string]string{
+		"warlock": `{"name":"Lazer tag","subclass":{"item":"100"}}`,
+		"hunter":  `{"name":"Borrowed","subclass":{"item":"100"}}`,
+	} {
+		if _, err := store.Create(class, "", fixtureBuild(t, data), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Create("hunter", "", fixtureBuild(t, `{"name":"Trapper","subclass":{"item":"101"}}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"", "?class=hunter", "?class=warlock"} {
+		w := httptest.NewRecorder()
+		GetBuilds(w, httptest.NewRequest("GET", "/api/destiny/builds/"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", query, w.Code, w.Body.String())
+		}
+
+		var classes map[string][]struct {
+			Name   string   `json:"name"`
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &classes); err != nil {
+			t.Fatal(err)
+		}
+		for class, builds := range classes {
+			for _, build := range builds {
+				if wrong := build.Name == "Borrowed"; wrong != (len(build.Errors) > 0) {
+					t.Errorf("%q: %s build %q has errors %v", query, class, build.Name, build.Errors)
+				}
+			}
+		}
+	}
+}
+
+func TestSeedBuildsUseKnownSlots(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "..", "resources", "builds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builds map[string][]Class
+	if err := json.Unmarshal(data, &builds); err != nil {
+		t.Fatal(err)
+	}
+	for class, list := range builds {
+		if err := checkClass(class); err != nil {
+			t.Error(err)
+		}
+		for _, build := range list {
+			for slot := range build.Slots {
+				if _, ok := SlotEquipment[slot]; !ok {
+					t.Errorf("the %s build %q has the unknown slot %s", class, build.Name, slot)
+				}
+			}
+		}
+	}
+}
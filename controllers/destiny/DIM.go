@@ -0,0 +1,478 @@
+package destiny
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SubclassBucket is the inventory bucket subclasses sit in
+const SubclassBucket Hash = 3284755031
+
+// DIM keeps the aspects of a subclass from socket 5 and the fragments from socket 7
+const (
+	dimAspectSocket   = 5
+	dimFragmentSocket = 7
+)
+
+// dimNotes starts the notes of an exported loadout, the share code after it holds the rest of the build
+const dimNotes = "Exported from projector, keep this line to import the whole build again: projector:"
+
+// dimNotesCode finds the share code in the notes, DIM users may have written around it
+var dimNotesCode = regexp.MustCompile(`projector:([A-Za-z0-9_-]+)`)
+
+// StatHashes maps the stat names used in a build's preference to their definitions
+var StatHashes = map[string]Hash{
+	"Mobility":   2996146975,
+	"Resilience": 392767087,
+	"Recovery":   1943323491,
+	"Discipline": 1735777505,
+	"Intellect":  144602215,
+	"Strength":   4244567218,
+}
+
+// DIMLoadout is the loadout json Destiny Item Manager imports and exports.
+// Only the parts a build maps to are kept, the rest is dropped on import.
+// What a build has that DIM can't hold travels as a share code in the notes.
+type DIMLoadout struct {
+	ID         string             `json:"id,omitempty"`
+	Name       string             `json:"name"`
+	Notes      string             `json:"notes,omitempty"`
+	ClassType  int                `json:"classType"`
+	Equipped   []DIMLoadoutItem   `json:"equipped"`
+	Unequipped []DIMLoadoutItem   `json:"unequipped"`
+	Parameters *DIMLoadoutOptions `json:"parameters,omitempty"`
+}
+
+type DIMLoadoutItem struct {
+	ID              string       `json:"id,omitempty"`
+	Hash            Hash         `json:"hash"`
+	SocketOverrides map[int]Hash `json:"socketOverrides,omitempty"`
+}
+
+type DIMLoadoutOptions struct {
+	StatConstraints []DIMStatConstraint `json:"statConstraints,omitempty"`
+	ModsByBucket    map[Hash][]Hash     `json:"modsByBucket,omitempty"`
+}
+
+type DIMStatConstraint struct {
+	StatHash Hash `json:"statHash"`
+}
+
+// dimLists are the lists of a slot that have somewhere to go in a DIM loadout,
+// the perks of a weapon become its socket overrides and the mods of an armor piece its modsByBucket entry
+var dimLists = map[string]string{
+	"kinetic":     "recomended_perks",
+	"energy":      "recomended_perks",
+	"heavy":       "recomended_perks",
+	"helmet":      "recomended_mods",
+	"gauntlets":   "recomended_mods",
+	"chest_armor": "recomended_mods",
+	"leg_armor":   "recomended_mods",
+	"class_armor": "recomended_mods",
+}
+
+func parseHashes(ids []string) ([]Hash, error) {
+	hashes := make([]Hash, 0, len(ids))
+	for _, id := range ids {
+		hash, err := ParseHash(id)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func hashStrings(hashes []Hash) []string {
+	ids := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		ids = append(ids, hash.String())
+	}
+	return ids
+}
+
+// weaponColumnsOf expands the sockets of every weapon of the build that has perks to place, keyed by slot.
+// A weapon missing from the manifest gets no columns, its perks are then kept in the notes.
+func weaponColumnsOf(build Class, store *ManifestStore) (map[string]*weaponColumns, error) {
+	hashes := make(map[string]Hash)
+	var lookup []Hash
+	for name, slot := range build.Slots {
+		if dimLists[name] != "recomended_perks" || slot.Item == "" || len(slot.Lists["recomended_perks"]) == 0 {
+			continue
+		}
+		hash, err := ParseHash(slot.Item)
+		if err != nil {
+			return nil, err
+		}
+		hashes[name] = hash
+		lookup = append(lookup, hash)
+	}
+	if len(lookup) == 0 {
+		return map[string]*weaponColumns{}, nil
+	}
+
+	raw, err := store.GetMany(itemTable, lookup)
+	if err != nil {
+		return nil, ManifestHTTPError(err)
+	}
+	columns := make(map[string]*weaponColumns, len(hashes))
+	for name, hash := range hashes {
+		data, ok := raw[hash]
+		if !ok {
+			continue
+		}
+		sockets, err := ExpandSockets(store, data)
+		if err != nil {
+			return nil, ManifestHTTPError(err)
+		}
+		columns[name] = newWeaponColumns(sockets)
+	}
+	return columns, nil
+}
+
+// weaponOverrides puts every perk in the socket it rolls in, the first perk of a column wins.
+// exact is false when reading the overrides back in socket order wouldn't give the same list.
+func weaponOverrides(columns *weaponColumns, perks []Hash) (map[int]Hash, bool) {
+	sockets := make(map[int]Hash, len(perks))
+	exact, last := true, -1
+	for _, hash := range perks {
+		socket := -1
+		if columns != nil {
+			socket = columns.perk(hash).Socket
+		}
+		if _, taken := sockets[socket]; socket < 0 || taken {
+			exact = false
+			continue
+		}
+		if socket < last {
+			exact = false
+		}
+		sockets[socket] = hash
+		last = socket
+	}
+	return sockets, exact
+}
+
+// ExportDIM turns a build into a DIM loadout. The perks of a weapon go in the sockets the manifest
+// says they roll in, whatever DIM has no place for, like optional mods, is packed as a share code in the notes.
+func ExportDIM(class string, build Class, store *ManifestStore) (DIMLoadout, error) {
+	classType, ok := ClassTypes[class]
+	if !ok {
+		return DIMLoadout{}, fmt.Errorf("unknown class %q", class)
+	}
+	loadout := DIMLoadout{Name: build.Name, ClassType: classType, Equipped: make([]DIMLoadoutItem, 0), Unequipped: make([]DIMLoadoutItem, 0)}
+	options := DIMLoadoutOptions{ModsByBucket: make(map[Hash][]Hash)}
+	rest := Class{Slots: make(map[string]Slot)}
+
+	for _, name := range build.Preference {
+		stat, ok := StatHashes[name]
+		if !ok {
+			return DIMLoadout{}, fmt.Errorf("unknown stat %q", name)
+		}
+		options.StatConstraints = append(options.StatConstraints, DIMStatConstraint{StatHash: stat})
+	}
+
+	if build.Subclass.Item == "" {
+		rest.Subclass = build.Subclass
+	} else {
+		hash, err := ParseHash(build.Subclass.Item)
+		if err != nil {
+			return DIMLoadout{}, err
+		}
+		aspects, err := parseHashes(build.Subclass.Lists["aspects"])
+		if err != nil {
+			return DIMLoadout{}, err
+		}
+		fragments, err := parseHashes(build.Subclass.Lists["fragments"])
+		if err != nil {
+			return DIMLoadout{}, err
+		}
+		if len(aspects) > dimFragmentSocket-dimAspectSocket {
+			return DIMLoadout{}, fmt.Errorf("DIM loadouts take at most %d aspects", dimFragmentSocket-dimAspectSocket)
+		}
+
+		subclass := DIMLoadoutItem{Hash: hash, SocketOverrides: make(map[int]Hash)}
+		for i, aspect := range aspects {
+			subclass.SocketOverrides[dimAspectSocket+i] = aspect
+		}
+		for i, fragment := range fragments {
+			subclass.SocketOverrides[dimFragmentSocket+i] = fragment
+		}
+		loadout.Equipped = append(loadout.Equipped, subclass)
+
+		rest.Subclass = Slot{Item: build.Subclass.Item, Lists: make(map[string][]string)}
+		for list, ids := range build.Subclass.Lists {
+			if list != "aspects" && list != "fragments" {
+				rest.Subclass.Lists[list] = ids
+			}
+		}
+	}
+
+	columns, err := weaponColumnsOf(build, store)
+	if err != nil {
+		return DIMLoadout{}, err
+	}
+
+	names := make([]string, 0, len(build.Slots))
+	for name := range build.Slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		slot := build.Slots[name]
+		list, ok := dimLists[name]
+		if !ok || slot.Item == "" && list == "recomended_perks" {
+			//DIM has no bucket for it, or no weapon to put the perks on
+			rest.Slots[name] = slot
+			continue
+		}
+		plugs, err := parseHashes(slot.Lists[list])
+		if err != nil {
+			return DIMLoadout{}, err
+		}
+
+		extra := Slot{Item: slot.Item, Lists: make(map[string][]string)}
+		for other, ids := range slot.Lists {
+			if other != list {
+				extra.Lists[other] = ids
+			}
+		}
+
+		if list == "recomended_mods" && len(plugs) > 0 {
+			options.ModsByBucket[SlotEquipment[name]] = plugs
+		}
+		if slot.Item != "" {
+			hash, err := ParseHash(slot.Item)
+			if err != nil {
+				return DIMLoadout{}, err
+			}
+			item := DIMLoadoutItem{Hash: hash}
+			if list == "recomended_perks" && len(plugs) > 0 {
+				sockets, exact := weaponOverrides(columns[name], plugs)
+				if len(sockets) > 0 {
+					item.SocketOverrides = sockets
+				}
+				if !exact {
+					//alternatives for a column and perks the weapon can't roll only survive in the notes
+					extra.Lists[list] = slot.Lists[list]
+				}
+			}
+			loadout.Equipped = append(loadout.Equipped, item)
+		}
+
+		if len(extra.Lists) > 0 {
+			rest.Slots[name] = extra
+		}
+	}
+
+	if len(options.StatConstraints) > 0 || len(options.ModsByBucket) > 0 {
+		loadout.Parameters = &options
+	}
+	if len(rest.Slots) > 0 || len(rest.Subclass.Lists) > 0 {
+		code, err := EncodeShareCode(class, rest)
+		if err != nil {
+			return DIMLoadout{}, err
+		}
+		loadout.Notes = dimNotes + code
+	}
+	return loadout, nil
+}
+
+// overrides lists the socket overrides from the given socket on, in socket order
+func overrides(sockets map[int]Hash, from, to int) []string {
+	indexes := make([]int, 0, len(sockets))
+	for index := range sockets {
+		if index >= from && (to < 0 || index < to) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	plugs := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		plugs = append(plugs, sockets[index].String())
+	}
+	return plugs
+}
+
+// ImportDIM turns a DIM loadout into a build, the manifest tells which slot each equipped item goes in
+func ImportDIM(loadout DIMLoadout, store *ManifestStore) (string, Class, error) {
+	class, ok := shareClasses[loadout.ClassType]
+	if !ok {
+		return "", Class{}, functions.BadRequest(fmt.Sprintf("The loadout is for class type %d, builds are for titans, hunters or warlocks", loadout.ClassType))
+	}
+	build := Class{Name: loadout.Name, Slots: make(map[string]Slot)}
+	if strings.TrimSpace(build.Name) == "" {
+		build.Name = "DIM loadout"
+	}
+
+	hashes := make([]Hash, 0, len(loadout.Equipped))
+	for _, item := range loadout.Equipped {
+		hashes = append(hashes, item.Hash)
+	}
+	raw, err := store.GetMany(itemTable, hashes)
+	if err != nil {
+		return "", Class{}, ManifestHTTPError(err)
+	}
+
+	slots := make(map[Hash]string, len(SlotEquipment))
+	for name, bucket := range SlotEquipment {
+		slots[bucket] = name
+	}
+
+	for _, item := range loadout.Equipped {
+		data, ok := raw[item.Hash]
+		if !ok {
+			return "", Class{}, functions.BadRequest(fmt.Sprintf("Item %s is not in the destiny manifest", item.Hash))
+		}
+		var definition struct {
+			Inventory struct {
+				BucketTypeHash Hash `json:"bucketTypeHash"`
+			} `json:"inventory"`
+		}
+		if err := json.Unmarshal(data, &definition); err != nil {
+			return "", Class{}, functions.Internal("Unable to read the destiny manifest", err)
+		}
+
+		bucket := definition.Inventory.BucketTypeHash
+		if bucket == SubclassBucket {
+			build.Subclass = Slot{Item: item.Hash.String(), Lists: map[string][]string{
+				"aspects":   overrides(item.SocketOverrides, dimAspectSocket, dimFragmentSocket),
+				"fragments": overrides(item.SocketOverrides, dimFragmentSocket, -1),
+			}}
+			continue
+		}
+		name, ok := slots[bucket]
+		if !ok {
+			return "", Class{}, functions.BadRequest(fmt.Sprintf("Item %s does not go in any slot of a build", item.Hash))
+		}
+		slot := Slot{Item: item.Hash.String(), Lists: make(map[string][]string)}
+		if dimLists[name] == "recomended_perks" {
+			slot.Lists["recomended_perks"] = overrides(item.SocketOverrides, 0, -1)
+		} else {
+			slot.Lists["recomended_mods"] = []string{}
+		}
+		build.Slots[name] = slot
+	}
+
+	if loadout.Parameters != nil {
+		for _, constraint := range loadout.Parameters.StatConstraints {
+			for name, stat := range StatHashes {
+				if stat == constraint.StatHash {
+					build.Preference = append(build.Preference, name)
+				}
+			}
+		}
+		for bucket, mods := range loadout.Parameters.ModsByBucket {
+			name, ok := slots[bucket]
+			if !ok || dimLists[name] != "recomended_mods" {
+				continue
+			}
+			slot, ok := build.Slots[name]
+			if !ok {
+				slot = Slot{Lists: make(map[string][]string)}
+			}
+			slot.Lists["recomended_mods"] = hashStrings(mods)
+			build.Slots[name] = slot
+		}
+	}
+
+	if match := dimNotesCode.FindStringSubmatch(loadout.Notes); match != nil {
+		restClass, rest, err := DecodeShareCode(match[1])
+		if err != nil {
+			return "", Class{}, functions.BadRequest("Unable to read the build in the loadout notes: " + err.Error())
+		}
+		if restClass != class {
+			return "", Class{}, functions.BadRequest(fmt.Sprintf("The build in the loadout notes is for a %s, the loadout for a %s", restClass, class))
+		}
+
+		//what the notes keep for a slot only applies while the item wasn't swapped in DIM
+		if rest.Subclass.Item == build.Subclass.Item {
+			build.Subclass = mergeLists(build.Subclass, rest.Subclass)
+		}
+		for name, extra := range rest.Slots {
+			slot := build.Slots[name]
+			if _, ok := dimLists[name]; ok && slot.Item != extra.Item {
+				continue
+			}
+			build.Slots[name] = mergeLists(slot, extra)
+		}
+	}
+	return class, build, nil
+}
+
+// mergeLists adds the lists of extra to the slot, replacing the ones it already has
+func mergeLists(slot Slot, extra Slot) Slot {
+	merged := Slot{Item: extra.Item, Lists: make(map[string][]string, len(slot.Lists)+len(extra.Lists))}
+	for list, ids := range slot.Lists {
+		merged.Lists[list] = ids
+	}
+	for list, ids := range extra.Lists {
+		merged.Lists[list] = ids
+	}
+	return merged
+}
+
+// PostBuildImport stores the DIM loadout in the body as a new build
+func PostBuildImport(w http.ResponseWriter, router *http.Request) {
+	var loadout DIMLoadout
+	if err := json.NewDecoder(router.Body).Decode(&loadout); err != nil {
+		functions.WriteError(w, functions.BadRequest("Unable to read the DIM loadout: "+err.Error()))
+		return
+	}
+
+	class, build, err := ImportDIM(loadout, Manifest.Store(DefaultManifestLocale))
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	if err := validateBuild(class, build); err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+
+	stored, err := Builds.Create(class, "", build, Author(router))
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	writeBuild(w, http.StatusCreated, stored)
+}
+
+// GetBuildExport answers with a stored build in another tool's format, only DIM for now
+func GetBuildExport(w http.ResponseWriter, router *http.Request) {
+	format := router.URL.Query().Get("format")
+	if format != "" && format != "dim" {
+		functions.WriteError(w, functions.BadRequest("Unknown export format "+strconv.Quote(format)+", expected dim"))
+		return
+	}
+
+	stored, err := Builds.Find(mux.Vars(router)["id"])
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	loadout, err := ExportDIM(stored.Class, stored.Build, Manifest.Store(DefaultManifestLocale))
+	if err != nil {
+		var httpErr *functions.Error
+		if !errors.As(err, &httpErr) {
+			err = functions.Internal("Unable to export the build", err)
+		}
+		functions.WriteError(w, err)
+		return
+	}
+	loadout.ID = stored.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadout)
+}
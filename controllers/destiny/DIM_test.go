@@ -0,0 +1,213 @@
+package destiny
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dimManifest has a subclass, a kinetic weapon whose barrel, magazine and two perk columns sit in sockets 1 to 4,
+// a heavy weapon with a single intrinsic and a couple of armor pieces, all with the buckets DIM imports by
+func dimManifest(t *testing.T) *ManifestStore {
+	plug := func(name string) string {
+		return `{"displayProperties":{"name":"` + name + `"},"plug":{"plugCategoryIdentifier":"frames"}}`
+	}
+	return testManifest(t, fixtureTables{
+		itemTable: {
+			100: `{"displayProperties":{"name":"Voidwalker"},"classType":2,"inventory":{"bucketTypeHash":3284755031}}`,
+			400: `{"displayProperties":{"name":"Funnelweb"},"classType":3,"inventory":{"bucketTypeHash":1498876634},
+				"sockets":{"socketEntries":[{"singleInitialItemHash":450},{"randomizedPlugSetHash":600},
+				{"randomizedPlugSetHash":601},{"randomizedPlugSetHash":602},{"randomizedPlugSetHash":603}]}}`,
+			401: `{"displayProperties":{"name":"Gjallarhorn"},"classType":3,"inventory":{"bucketTypeHash":953998645},
+				"sockets":{"socketEntries":[{"singleInitialItemHash":460}]}}`,
+			410: `{"displayProperties":{"name":"Nezarec's Sin"},"classType":2,"inventory":{"bucketTypeHash":3448274439}}`,
+			411: `{"displayProperties":{"name":"Sunbracers"},"classType":2,"inventory":{"bucketTypeHash":3551918588}}`,
+			450: plug("Lightweight Frame"),
+			451: plug("Arrowhead Brake"),
+			452: plug("Fluted Barrel"),
+			453: plug("Appended Mag"),
+			454: plug("Tactical Mag"),
+			455: plug("Subsistence"),
+			456: plug("Threat Detector"),
+			457: plug("Frenzy"),
+			460: plug("Wolfpack Rounds"),
+		},
+		plugSetTable: {
+			600: `{"reusablePlugItems":[{"plugItemHash":451},{"plugItemHash":452}]}`,
+			601: `{"reusablePlugItems":[{"plugItemHash":453},{"plugItemHash":454}]}`,
+			602: `{"reusablePlugItems":[{"plugItemHash":455},{"plugItemHash":456}]}`,
+			603: `{"reusablePlugItems":[{"plugItemHash":457}]}`,
+		},
+	}).Store(DefaultManifestLocale)
+}
+
+// dimFixture reads a build kept under testdata/dim
+func dimFixture(t *testing.T, name string) (string, Class) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "dim", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture struct {
+		Class string `json:"class"`
+		Build Class  `json:"build"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	return fixture.Class, fixture.Build
+}
+
+// throughJSON sends the loadout through json the way DIM gets and gives it back
+func throughJSON(t *testing.T, loadout DIMLoadout) DIMLoadout {
+	t.Helper()
+	data, err := json.Marshal(loadout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read DIMLoadout
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func sameBuild(t *testing.T, got, want Class) {
+	t.Helper()
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("build changed on the way\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func findEquipped(loadout DIMLoadout, hash Hash) DIMLoadoutItem {
+	for _, item := range loadout.Equipped {
+		if item.Hash == hash {
+			return item
+		}
+	}
+	return DIMLoadoutItem{}
+}
+
+func TestDIMRoundTrip(t *testing.T) {
+	store := dimManifest(t)
+
+	tests := []struct {
+		fixture string
+		notes   bool
+		kinetic map[int]Hash
+	}{
+		//one perk per column in socket order fits the socket overrides as it is
+		{fixture: "exact.json", kinetic: map[int]Hash{1: 451, 2: 453, 3: 455, 4: 457}},
+		//alternatives, a perk the weapon can't roll, optional mods and a slot DIM doesn't know go in the notes
+		{fixture: "notes.json", notes: true, kinetic: map[int]Hash{1: 452, 3: 455}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			class, build := dimFixture(t, test.fixture)
+			loadout, err := ExportDIM(class, build, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hasNotes := loadout.Notes != ""; hasNotes != test.notes {
+				t.Errorf("expected notes %v, got %q", test.notes, loadout.Notes)
+			}
+			kinetic := findEquipped(loadout, 400).SocketOverrides
+			if len(kinetic) != len(test.kinetic) {
+				t.Errorf("expected the kinetic overrides %v, got %v", test.kinetic, kinetic)
+			}
+			for socket, hash := range test.kinetic {
+				if kinetic[socket] != hash {
+					t.Errorf("expected %s in socket %d, got %v", hash, socket, kinetic)
+				}
+			}
+
+			importedClass, imported, err := ImportDIM(throughJSON(t, loadout), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if importedClass != class {
+				t.Errorf("expected a %s build, got %s", class, importedClass)
+			}
+			sameBuild(t, imported, build)
+		})
+	}
+}
+
+func TestDIMNotesFollowTheItem(t *testing.T) {
+	store := dimManifest(t)
+	class, build := dimFixture(t, "notes.json")
+	loadout, err := ExportDIM(class, build, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the kinetic weapon was swapped for another one in DIM, what the notes say about the old one is dropped
+	for i, item := range loadout.Equipped {
+		if item.Hash == 400 {
+			loadout.Equipped[i] = DIMLoadoutItem{Hash: 401}
+		}
+	}
+	loadout.Notes = "Swapped the kinetic. " + loadout.Notes
+
+	_, imported, err := ImportDIM(throughJSON(t, loadout), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := imported.Slots["kinetic"]; ok {
+		t.Errorf("the swapped out kinetic came back: %+v", imported.Slots["kinetic"])
+	}
+	if heavy := imported.Slots["heavy"]; heavy.Item != "401" || len(heavy.Lists["optional_perks"]) > 0 {
+		t.Errorf("the notes of the old kinetic ended up on %+v", heavy)
+	}
+	sameBuild(t, Class{Slots: map[string]Slot{"helmet": imported.Slots["helmet"], "artifact": imported.Slots["artifact"]}},
+		Class{Slots: map[string]Slot{"helmet": build.Slots["helmet"], "artifact": build.Slots["artifact"]}})
+}
+
+func TestImportDIMLoadout(t *testing.T) {
+	store := dimManifest(t)
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "dim", "loadout.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loadout DIMLoadout
+	if err := json.Unmarshal(data, &loadout); err != nil {
+		t.Fatal(err)
+	}
+
+	class, build, err := ImportDIM(loadout, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class != "warlock" {
+		t.Errorf("expected a warlock build, got %s", class)
+	}
+	sameBuild(t, build, fixtureBuild(t, `{"name":"Funnelweb Voidwalker","preference":["Discipline","Intellect"],
+		"subclass":{"item":"100","aspects":["200","201"],"fragments":["300","301"]},
+		"kinetic":{"item":"400","recomended_perks":["452","454","456","457"]},
+		"helmet":{"item":"410","recomended_mods":["420","421"]}}`))
+
+	//and back out again the perks land in the sockets they came from
+	exported, err := ExportDIM(class, build, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for socket, hash := range loadout.Equipped[1].SocketOverrides {
+		if findEquipped(exported, 400).SocketOverrides[socket] != hash {
+			t.Errorf("expected %s in socket %d, got %v", hash, socket, findEquipped(exported, 400).SocketOverrides)
+		}
+	}
+}
+
+func TestImportDIMBrokenNotes(t *testing.T) {
+	store := dimManifest(t)
+	loadout := DIMLoadout{Name: "Broken", ClassType: 2, Notes: dimNotes + "AAAA"}
+	if _, _, err := ImportDIM(loadout, store); err == nil || !strings.Contains(err.Error(), "loadout notes") {
+		t.Errorf("expected the broken notes to be refused, got %v", err)
+	}
+}
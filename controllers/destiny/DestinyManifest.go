@@ -2,15 +2,20 @@ package destiny
 
 import (
 	"archive/zip"
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"projector/controllers/functions"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -165,7 +170,7 @@ type Item struct {
 	IsWrapper                         bool     `json:"isWrapper"`
 	TraitIds                          []string `json:"traitIds"`
 	TraitHashes                       []int64  `json:"traitHashes"`
-	Hash                              int64    `json:"hash"`
+	Hash                              Hash     `json:"hash"`
 	Index                             int      `json:"index"`
 	Redacted                          bool     `json:"redacted"`
 	Blacklisted                       bool     `json:"blacklisted"`
@@ -2237,182 +2242,197 @@ type AutoGenerated struct {
 	} `json:"MessageData"`
 }
 
-func GenerateManifest() {
-	client := http.Client{}
-	request, error := http.NewRequest("GET", "http://www.bungie.net/Platform/Destiny2/Manifest/", nil)
-	if error != nil {
-		log.Fatal("Unable to create request")
+// GenerateManifest builds the database at dbPath from a downloaded world content zip with every given table keyed by hash,
+// the new database only replaces the old one once it is complete
+func GenerateManifest(archive []byte, dbPath string, tables []string) error {
+	resp, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return fmt.Errorf("unable to open the manifest zip: %w", err)
 	}
-	request.Header.Add("X-API-Key", "a8d4879a0fe04169aa7c7b782265f964")
-	response, error := client.Do(request)
 
-	if error != nil {
-		log.Fatal("Unable to send request to bungie")
+	//the zip holds a single world_sql_content_<hash>.content file whose name changes with every version
+	var content *zip.File
+	for _, file := range resp.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if content == nil || strings.HasSuffix(file.Name, ".content") {
+			content = file
+		}
 	}
-
-	defer response.Body.Close()
-	body, error := ioutil.ReadAll(response.Body)
-	if error != nil {
-		log.Fatal("Unable to read mobileworld data")
+	if content == nil {
+		return fmt.Errorf("the manifest zip is empty")
 	}
 
-	var data ManifestURL
-	json.Unmarshal(body, &data)
-	if error != nil {
-		log.Fatal("Unable to read mobileworld data")
+	dir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
-	url := "http://www.bungie.net" + data.Response.MobileWorldContentPaths.En
 
-	request2, error := http.NewRequest("GET", string(url), nil)
-	if error != nil {
-		log.Fatal("Unable to create request")
-	}
-	request2.Header.Add("X-API-Key", "a8d4879a0fe04169aa7c7b782265f964")
-	response2, error := client.Do(request2)
-	if error != nil {
-		log.Fatal("Request to bungie failed")
+	//extracting it to the a manifest.content file for comucating with sqlite.
+	contentPath := filepath.Join(dir, filepath.Base(content.Name))
+	if err := extract(content, contentPath); err != nil {
+		return fmt.Errorf("unable to extract %s: %w", content.Name, err)
 	}
-	defer response2.Body.Close()
-	body2, error := ioutil.ReadAll(response2.Body)
+	defer os.Remove(contentPath)
 
-	var manifest AutoGenerated
-	json.Unmarshal(body2, &manifest)
+	//attempting to do this in a database
+	tmpPath := dbPath + ".tmp"
+	os.Remove(tmpPath)
 
-	os.MkdirAll("./controllers/destiny/manifest", 0755)
-	//writting the data to a zip file
-	file, error := os.Create("./controllers/destiny/manifest/manifest.zip")
-	if error != nil {
-		log.Fatal("Unable to generate manifest.zip")
+	newDB, err := sql.Open("sqlite3", tmpPath)
+	if err != nil {
+		return fmt.Errorf("unable to open database: %w", err)
 	}
+	defer newDB.Close()
 
-	defer file.Close()
-	file.WriteString(string(body2))
-
-	//extracting it to the a manifest.content file for comucating with sqlite.
-
-	resp, err := zip.OpenReader("./controllers/destiny/manifest/manifest.zip")
+	//putting it all into a manifest.content file with the hashes rather than id
+	db, err := sql.Open("sqlite3", contentPath)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("unable to load destiny manifest file: %w", err)
 	}
+	defer db.Close()
 
-	for _, file := range resp.File {
-
-		f, err := file.Open()
-		if err != nil {
-			log.Fatal("Unable to open file")
+	for _, table := range tables {
+		if err := importTable(db, newDB, table); err != nil {
+			return err
 		}
-		defer func() {
-			err := f.Close()
-			if err != nil {
-				log.Fatal("Unable to close file")
-			}
-		}()
-
-		path := filepath.Join("./controllers/destiny/manifest", file.Name)
-
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(path, file.Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(path), file.Mode())
-			fs, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-
-			if err != nil {
-				log.Fatal("Unable to open the file")
-			}
-
-			defer func() {
-				err := f.Close()
-				if err != nil {
-					log.Fatal("Unable to close the file")
-				}
-			}()
+	}
 
-			_, err = io.Copy(fs, f)
-			if err != nil {
-				panic("Unable to copy data")
-			}
+	for _, table := range tables {
+		if table != itemTable {
+			continue
+		}
+		err := buildSearchIndex(newDB)
+		if isMissingFTS5(err) {
+			log.Println("Skipping the item search index, sqlite is built without fts5")
+		} else if err != nil {
+			return fmt.Errorf("unable to build the item search index: %w", err)
 		}
 	}
 
-	//attempting to do this in a database
-	dbfile, error := os.Create("./controllers/destiny/manifest/manifest.db")
-	if error != nil {
-		log.Fatal(error)
+	if err := newDB.Close(); err != nil {
+		return err
 	}
-	dbfile.Close()
 
-	newDB, error := sql.Open("sqlite3", "./controllers/destiny/manifest/manifest.db")
-	if error != nil {
-		log.Fatal(error)
-		log.Fatal("Unable to open database")
-	}
+	//readers that already opened the old database keep it until they close it
+	return os.Rename(tmpPath, dbPath)
+}
 
-	_, error = newDB.Exec(
-		"DROP TABLE IF EXISTS `DestinyInventoryItemDefinition`;" +
-			"CREATE TABLE `DestinyInventoryItemDefinition` (`hash` VARCHAR(30) NOT NULL PRIMARY KEY, `json` BLOB NOT NULL);") //+
-	//"CREATE TABLE `DestinySandboxPerkDefinition` (`hash` VARCHAR(30) NOT NULL PRIMARY KEY, `json` BLOB NOT NULL);")
-	if error != nil {
-		log.Fatal(error)
-		log.Fatal("Unable to create table")
+// importTable copies a definition table over, keyed by the unsigned hash instead of the signed id bungie uses
+func importTable(db, newDB *sql.DB, table string) error {
+	_, err := newDB.Exec(
+		"DROP TABLE IF EXISTS `" + table + "`;" +
+			"CREATE TABLE `" + table + "` (`hash` VARCHAR(30) NOT NULL PRIMARY KEY, `json` BLOB NOT NULL);")
+	if err != nil {
+		return fmt.Errorf("unable to create table %s: %w", table, err)
 	}
 
-	//putting it all into a manifest.content file with the hashes rather than id
-	db, error := sql.Open("sqlite3", "./controllers/destiny/manifest/world_sql_content_c1d4ac435e5ce5b3046fe2d0e6190ce4.content")
-	if error != nil {
-		log.Fatal("Unable to load destiny manifest file")
+	rows, err := db.Query("SELECT * FROM " + table)
+	if err != nil {
+		return fmt.Errorf("unable to query %s from the destiny manifest: %w", table, err)
+	}
+	defer rows.Close()
 
+	tx, err := newDB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	rows, error := db.Query("SELECT * FROM DestinyInventoryItemDefinition")
-	if error != nil {
-		log.Fatal("Unable to query the destiny manifest")
+	insert, err := tx.Prepare("INSERT INTO `" + table + "` (hash, json) VALUES (?,?)")
+	if err != nil {
+		return err
 	}
+	defer insert.Close()
 
-	var idd int
+	var idd int64
 	var jsondata string
+	var mismatches []string
 	for rows.Next() {
-		rows.Scan(&idd, &jsondata)
-		var tmp Item
-		json.Unmarshal([]byte(jsondata), &tmp)
-		hash := fmt.Sprintf("%v", tmp.Hash)
-
-		out, _ := json.Marshal(tmp)
+		if err := rows.Scan(&idd, &jsondata); err != nil {
+			return err
+		}
 
-		_, error = newDB.Exec("INSERT INTO DestinyInventoryItemDefinition (hash, json) VALUES (?,?)", hash, string(out))
-		if error != nil {
+		//only the hash is decoded, the row itself is stored untouched
+		var tmp struct {
+			Hash Hash `json:"hash"`
+		}
+		if err := json.Unmarshal([]byte(jsondata), &tmp); err != nil {
+			return fmt.Errorf("unable to read row %d of %s: %w", idd, table, err)
+		}
+		hash := tmp.Hash
 
-			fmt.Println("Unable to inserts destiny items to manifest")
-			log.Fatal(error)
+		//the row id and the json hash are the same 32 bits, anything else means the row can't be found by hash
+		if HashFromID(idd) != hash {
+			mismatches = append(mismatches, fmt.Sprintf("id %d has hash %s", idd, hash))
+			continue
 		}
 
+		_, err = insert.Exec(hash.String(), jsondata)
+		if err != nil {
+			return fmt.Errorf("unable to insert %s rows to manifest: %w", table, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d rows of %s don't match their hash, first: %s", len(mismatches), table, mismatches[0])
 	}
 
-	/*
-		rows, error = db.Query("SELECT * FROM DestinySandboxPerkDefinition")
-		if error != nil {
-			log.Fatal("Unable to query the destiny manifest")
-		}
+	return tx.Commit()
+}
 
-		for rows.Next() {
-			rows.Scan(&idd, &jsondata)
-			var tmp Item
-			json.Unmarshal([]byte(jsondata), &tmp)
+// bungieClient gives up on bungie instead of hanging the manifest updater. Bungie has to start
+// answering quickly, the whole download may take longer since the world content archive is large.
+var bungieClient = &http.Client{
+	Timeout: 10 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
 
-			hash := fmt.Sprintf("%v", tmp.Hash)
-			out, _ := json.Marshal(tmp)
+// bungieGet sends a request to bungie with our api key
+func bungieGet(url string) ([]byte, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("X-API-Key", "a8d4879a0fe04169aa7c7b782265f964")
 
-			_, error = newDB.Exec("INSERT INTO DestinySandboxPerkDefinition (hash, json) VALUES (?,?)", hash, string(out))
-			if error != nil {
-				fmt.Println("Unable to insert perks to manifest")
-				fmt.Println(error)
-			}
+	response, err := bungieClient.Do(request)
+	if err != nil {
+		return nil, functions.Upstream("Unable to send request to bungie", 0, err)
+	}
+	defer response.Body.Close()
 
-		}
-	*/
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, functions.Upstream("Unable to read the answer from bungie", 0, err)
+	}
+	if response.StatusCode >= 300 {
+		return nil, functions.Upstream("Bungie refused the request", response.StatusCode, nil)
+	}
+	return body, nil
+}
+
+func extract(file *zip.File, path string) error {
+	f, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fs, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
 
-	newDB.Close()
-	//e := os.Remove("./controllers/destiny/manifest/manifest.zip")
-	//if e != nil {
-	//	log.Fatal("Unable to delete manifest.zip")
-	//}
+	_, err = io.Copy(fs, f)
+	return err
 }
@@ -0,0 +1,113 @@
+package destiny
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// fixtureTables are manifest rows by table and hash, the hash field of each row is filled in
+type fixtureTables map[string]map[Hash]string
+
+// worldContent zips the rows up the way bungie ships them, keyed by the signed id
+func worldContent(tb testing.TB, tables fixtureTables) []byte {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "world_sql_content_fixture.content")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer db.Close()
+
+	for table, rows := range tables {
+		if _, err := db.Exec("CREATE TABLE " + table + " (id INTEGER PRIMARY KEY NOT NULL, json BLOB)"); err != nil {
+			tb.Fatal(err)
+		}
+		for hash, row := range rows {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(row), &fields); err != nil {
+				tb.Fatalf("fixture %s %s: %v", table, hash, err)
+			}
+			fields["hash"] = uint32(hash)
+			data, _ := json.Marshal(fields)
+			if _, err := db.Exec("INSERT INTO "+table+" VALUES (?, ?)", hash.ID(), string(data)); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	file, err := writer.Create(filepath.Base(path))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	file.Write(data)
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// testManifest generates an english manifest database from the rows with GenerateManifest
+// and serves it in place of the real one until the test ends
+func testManifest(tb testing.TB, tables fixtureTables) *ManifestService {
+	tb.Helper()
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	service := &ManifestService{Dir: tb.TempDir(), Tables: names, Locales: []string{DefaultManifestLocale}}
+	if err := GenerateManifest(worldContent(tb, tables), service.Path(DefaultManifestLocale), names); err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := Manifest
+	Manifest = service
+	tb.Cleanup(func() {
+		for _, store := range service.stores {
+			store.Close()
+		}
+		Manifest = previous
+	})
+	return service
+}
+
+// testBuilds swaps the build store for an empty one in a temporary directory
+func testBuilds(tb testing.TB) *BuildStore {
+	tb.Helper()
+	store := &BuildStore{Path: filepath.Join(tb.TempDir(), "builds.db")}
+	previous := Builds
+	Builds = store
+	tb.Cleanup(func() {
+		if store.db != nil {
+			store.db.Close()
+		}
+		Builds = previous
+	})
+	return store
+}
+
+// fixtureBuild reads a build written the way builds.json writes them
+func fixtureBuild(tb testing.TB, data string) Class {
+	tb.Helper()
+	var build Class
+	if err := json.Unmarshal([]byte(data), &build); err != nil {
+		tb.Fatal(err)
+	}
+	return build
+}
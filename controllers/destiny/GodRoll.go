@@ -0,0 +1,315 @@
+package destiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RollPerk is a perk of a roll, Socket is the column it sits in or -1 when the weapon has no column for it
+type RollPerk struct {
+	Hash   Hash   `json:"hash"`
+	Name   string `json:"name"`
+	Socket int    `json:"socket"`
+}
+
+// ColumnScore compares what a build recommends for one socket column with what was rolled in it
+type ColumnScore struct {
+	Socket      int        `json:"socket"`
+	Category    string     `json:"category"`
+	Recommended []RollPerk `json:"recommended"`
+	Rolled      []RollPerk `json:"rolled"`
+	Matched     []RollPerk `json:"matched"`
+	Missing     []RollPerk `json:"missing"`
+}
+
+// RollScore is how well a roll fits one build, Score is the share of recommended columns
+// the roll has at least one of the recommended perks in
+type RollScore struct {
+	ID         string        `json:"id"`
+	Class      string        `json:"class"`
+	Name       string        `json:"name"`
+	Slot       string        `json:"slot"`
+	Score      float64       `json:"score"`
+	Matched    []RollPerk    `json:"matched"`
+	Missing    []RollPerk    `json:"missing"`
+	Unrollable []RollPerk    `json:"unrollable"`
+	Columns    []ColumnScore `json:"columns"`
+}
+
+type RollEvaluation struct {
+	Item   DiffItem    `json:"item"`
+	Perks  []RollPerk  `json:"perks"`
+	Builds []RollScore `json:"builds"`
+}
+
+// weaponColumns knows which socket of a weapon every plug it can roll goes in
+type weaponColumns struct {
+	sockets []SocketDetail
+	socket  map[Hash]int
+	names   map[Hash]string
+}
+
+func newWeaponColumns(sockets []SocketDetail) *weaponColumns {
+	columns := &weaponColumns{sockets: sockets, socket: make(map[Hash]int), names: make(map[Hash]string)}
+	for _, socket := range sockets {
+		plugs := append(append([]PlugDetail{}, socket.Reusable...), socket.Randomized...)
+		if socket.Initial != nil {
+			plugs = append(plugs, *socket.Initial)
+		}
+		for _, plug := range plugs {
+			//a plug that fits several sockets belongs to the first one
+			if _, ok := columns.socket[plug.Hash]; !ok {
+				columns.socket[plug.Hash] = socket.Index
+			}
+			columns.names[plug.Hash] = plug.Name
+		}
+	}
+	return columns
+}
+
+func (columns *weaponColumns) perk(hash Hash) RollPerk {
+	socket, ok := columns.socket[hash]
+	if !ok {
+		socket = -1
+	}
+	return RollPerk{Hash: hash, Name: columns.names[hash], Socket: socket}
+}
+
+func (columns *weaponColumns) category(socket int) string {
+	for _, detail := range columns.sockets {
+		if detail.Index == socket {
+			return detail.Category
+		}
+	}
+	return ""
+}
+
+// scoreRoll scores the rolled perks against the recommended perks of one build column by column
+func scoreRoll(columns *weaponColumns, rolled []RollPerk, recommended []Hash) RollScore {
+	score := RollScore{Matched: []RollPerk{}, Missing: []RollPerk{}, Unrollable: []RollPerk{}, Columns: []ColumnScore{}}
+
+	bySocket := make(map[int]*ColumnScore)
+	var order []int
+	for _, hash := range recommended {
+		perk := columns.perk(hash)
+		if perk.Socket < 0 {
+			score.Unrollable = append(score.Unrollable, perk)
+			continue
+		}
+		column, ok := bySocket[perk.Socket]
+		if !ok {
+			column = &ColumnScore{Socket: perk.Socket, Category: columns.category(perk.Socket),
+				Recommended: []RollPerk{}, Rolled: []RollPerk{}, Matched: []RollPerk{}, Missing: []RollPerk{}}
+			bySocket[perk.Socket] = column
+			order = append(order, perk.Socket)
+		}
+		column.Recommended = append(column.Recommended, perk)
+	}
+	sort.Ints(order)
+
+	matchedColumns := 0
+	for _, socket := range order {
+		column := bySocket[socket]
+		has := make(map[Hash]bool)
+		for _, perk := range rolled {
+			if perk.Socket == socket {
+				column.Rolled = append(column.Rolled, perk)
+				has[perk.Hash] = true
+			}
+		}
+		for _, perk := range column.Recommended {
+			if has[perk.Hash] {
+				column.Matched = append(column.Matched, perk)
+			} else {
+				column.Missing = append(column.Missing, perk)
+			}
+		}
+		if len(column.Matched) > 0 {
+			matchedColumns++
+		}
+		score.Matched = append(score.Matched, column.Matched...)
+		score.Missing = append(score.Missing, column.Missing...)
+		score.Columns = append(score.Columns, *column)
+	}
+	if len(order) > 0 {
+		score.Score = float64(matchedColumns) / float64(len(order))
+	}
+	return score
+}
+
+// instanceRoll reads the perks of an item a player owns from bungie. Columns that let the player
+// switch perks count every perk in them, other sockets count what is plugged in.
+func instanceRoll(membershipType, membershipID, instanceID string) (Hash, map[int][]Hash, error) {
+	for _, value := range []string{membershipType, membershipID, instanceID} {
+		if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+			return 0, nil, functions.BadRequest("instance, membershipType and membershipId have to be numbers")
+		}
+	}
+
+	body, err := bungieGet(fmt.Sprintf("%s/Platform/Destiny2/%s/Profile/%s/Item/%s/?components=305,307,310",
+		Manifest.BaseURL, membershipType, membershipID, instanceID))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var data struct {
+		Response struct {
+			Item struct {
+				Data struct {
+					ItemHash Hash `json:"itemHash"`
+				} `json:"data"`
+			} `json:"item"`
+			Sockets struct {
+				Data struct {
+					Sockets []struct {
+						PlugHash Hash `json:"plugHash"`
+					} `json:"sockets"`
+				} `json:"data"`
+			} `json:"sockets"`
+			ReusablePlugs struct {
+				Data struct {
+					Plugs map[string][]struct {
+						PlugItemHash Hash `json:"plugItemHash"`
+					} `json:"plugs"`
+				} `json:"data"`
+			} `json:"reusablePlugs"`
+		} `json:"Response"`
+		ErrorCode int    `json:"ErrorCode"`
+		Message   string `json:"Message"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return 0, nil, functions.Upstream("Unable to read the item from bungie", 0, err)
+	}
+	if data.ErrorCode != 1 {
+		return 0, nil, functions.Upstream("Bungie refused the request: "+data.Message, http.StatusBadRequest, nil)
+	}
+
+	perks := make(map[int][]Hash)
+	for index, socket := range data.Response.Sockets.Data.Sockets {
+		if socket.PlugHash != 0 {
+			perks[index] = []Hash{socket.PlugHash}
+		}
+	}
+	for key, plugs := range data.Response.ReusablePlugs.Data.Plugs {
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		perks[index] = make([]Hash, 0, len(plugs))
+		for _, plug := range plugs {
+			perks[index] = append(perks[index], plug.PlugItemHash)
+		}
+	}
+	return data.Response.Item.Data.ItemHash, perks, nil
+}
+
+// GetGodRoll scores a roll of a weapon against every build that recommends perks for it.
+// The roll is given as ?perks=hash,hash or as an owned item with ?instance=&membershipType=&membershipId=
+func GetGodRoll(w http.ResponseWriter, router *http.Request) {
+	hash, err := ParseHash(mux.Vars(router)["hash"])
+	if err != nil {
+		functions.WriteError(w, functions.BadRequest(err.Error()))
+		return
+	}
+	query := router.URL.Query()
+
+	store := Manifest.Store(Language(router))
+	raw, err := store.GetRaw(itemTable, hash)
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+	var definition displayDefinition
+	if err := json.Unmarshal(raw, &definition); err != nil {
+		functions.WriteError(w, functions.Internal("Unable to read the destiny manifest", err))
+		return
+	}
+	sockets, err := ExpandSockets(store, raw)
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+	columns := newWeaponColumns(sockets)
+
+	evaluation := RollEvaluation{
+		Item:   DiffItem{Hash: hash.String(), Name: definition.DisplayProperties.Name},
+		Perks:  []RollPerk{},
+		Builds: []RollScore{},
+	}
+
+	switch {
+	case query.Get("instance") != "":
+		itemHash, plugged, err := instanceRoll(query.Get("membershipType"), query.Get("membershipId"), query.Get("instance"))
+		if err != nil {
+			functions.WriteError(w, err)
+			return
+		}
+		if itemHash != hash {
+			functions.WriteError(w, functions.BadRequest(fmt.Sprintf("Instance %s is item %s, not %s", query.Get("instance"), itemHash, hash)))
+			return
+		}
+		indexes := make([]int, 0, len(plugged))
+		for index := range plugged {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			for _, perk := range plugged[index] {
+				evaluation.Perks = append(evaluation.Perks, RollPerk{Hash: perk, Name: columns.names[perk], Socket: index})
+			}
+		}
+	case query.Get("perks") != "":
+		perks, err := parseHashes(strings.Split(query.Get("perks"), ","))
+		if err != nil {
+			functions.WriteError(w, functions.BadRequest(err.Error()))
+			return
+		}
+		for _, perk := range perks {
+			evaluation.Perks = append(evaluation.Perks, columns.perk(perk))
+		}
+	default:
+		functions.WriteError(w, functions.BadRequest("Give the rolled perks with perks or an owned item with instance"))
+		return
+	}
+
+	builds, err := Builds.List()
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+	for class, stored := range builds {
+		for _, build := range stored {
+			for name, slot := range build.Build.Slots {
+				//builds may keep the item as the signed id, compare the hashes rather than the text
+				item, err := ParseHash(slot.Item)
+				if err != nil || item != hash || len(slot.Lists["recomended_perks"]) == 0 {
+					continue
+				}
+				recommended, err := parseHashes(slot.Lists["recomended_perks"])
+				if err != nil {
+					functions.WriteError(w, functions.Internal("Build "+build.ID+" has an invalid perk", err))
+					return
+				}
+				score := scoreRoll(columns, evaluation.Perks, recommended)
+				score.ID, score.Class, score.Name, score.Slot = build.ID, class, build.Build.Name, name
+				evaluation.Builds = append(evaluation.Builds, score)
+			}
+		}
+	}
+	sort.Slice(evaluation.Builds, func(i, j int) bool {
+		if evaluation.Builds[i].Score != evaluation.Builds[j].Score {
+			return evaluation.Builds[i].Score > evaluation.Builds[j].Score
+		}
+		return evaluation.Builds[i].Name < evaluation.Builds[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evaluation)
+}
@@ -0,0 +1,185 @@
+package destiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// godRollSockets is a barrel column with a fixed intrinsic before it and two randomized perk columns,
+// Frenzy fits either perk column and so belongs to the first
+func godRollSockets() []SocketDetail {
+	plug := func(hash Hash, name string) PlugDetail {
+		return PlugDetail{Hash: hash, Name: name}
+	}
+	intrinsic := plug(450, "Lightweight Frame")
+	return []SocketDetail{
+		{Index: 0, Category: "intrinsic", Initial: &intrinsic},
+		{Index: 1, Category: "barrels", Reusable: []PlugDetail{plug(451, "Arrowhead Brake"), plug(452, "Fluted Barrel")}},
+		{Index: 3, Category: "perks", Randomized: []PlugDetail{plug(455, "Subsistence"), plug(457, "Frenzy")}},
+		{Index: 4, Category: "perks", Randomized: []PlugDetail{plug(456, "Threat Detector"), plug(457, "Frenzy")}},
+	}
+}
+
+func TestScoreRoll(t *testing.T) {
+	columns := newWeaponColumns(godRollSockets())
+
+	tests := []struct {
+		name        string
+		rolled      []Hash
+		recommended []Hash
+		score       float64
+		matched     []Hash
+		missing     []Hash
+		unrollable  []Hash
+		sockets     []int
+	}{
+		{
+			name:        "every column matched",
+			rolled:      []Hash{452, 455, 456},
+			recommended: []Hash{452, 455, 456},
+			score:       1,
+			matched:     []Hash{452, 455, 456},
+			sockets:     []int{1, 3, 4},
+		},
+		{
+			name:        "one of the alternatives is enough",
+			rolled:      []Hash{451, 455},
+			recommended: []Hash{452, 451},
+			score:       1,
+			matched:     []Hash{451},
+			missing:     []Hash{452},
+			sockets:     []int{1},
+		},
+		{
+			name:        "a column missing",
+			rolled:      []Hash{451, 455},
+			recommended: []Hash{451, 456},
+			score:       0.5,
+			matched:     []Hash{451},
+			missing:     []Hash{456},
+			sockets:     []int{1, 4},
+		},
+		{
+			name:        "unrollable perks don't count",
+			rolled:      []Hash{452},
+			recommended: []Hash{452, 999},
+			score:       1,
+			matched:     []Hash{452},
+			unrollable:  []Hash{999},
+			sockets:     []int{1},
+		},
+		{
+			name:        "nothing rollable recommended",
+			rolled:      []Hash{452},
+			recommended: []Hash{999},
+			unrollable:  []Hash{999},
+		},
+		{
+			name:        "the intrinsic is a column",
+			rolled:      []Hash{450},
+			recommended: []Hash{450, 455},
+			score:       0.5,
+			matched:     []Hash{450},
+			missing:     []Hash{455},
+			sockets:     []int{0, 3},
+		},
+	}
+
+	hashes := func(perks []RollPerk) string {
+		list := make([]Hash, 0, len(perks))
+		for _, perk := range perks {
+			list = append(list, perk.Hash)
+		}
+		return fmt.Sprint(list)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rolled []RollPerk
+			for _, hash := range test.rolled {
+				rolled = append(rolled, columns.perk(hash))
+			}
+			score := scoreRoll(columns, rolled, test.recommended)
+
+			if score.Score != test.score {
+				t.Errorf("expected a score of %v, got %v", test.score, score.Score)
+			}
+			for _, check := range []struct {
+				name string
+				got  []RollPerk
+				want []Hash
+			}{{"matched", score.Matched, test.matched}, {"missing", score.Missing, test.missing}, {"unrollable", score.Unrollable, test.unrollable}} {
+				if want := fmt.Sprint(append([]Hash{}, check.want...)); hashes(check.got) != want {
+					t.Errorf("expected %s %s, got %s", check.name, want, hashes(check.got))
+				}
+			}
+			var sockets []int
+			for _, column := range score.Columns {
+				sockets = append(sockets, column.Socket)
+			}
+			if fmt.Sprint(sockets) != fmt.Sprint(test.sockets) {
+				t.Errorf("expected the columns %v, got %v", test.sockets, sockets)
+			}
+		})
+	}
+}
+
+func TestNewWeaponColumns(t *testing.T) {
+	columns := newWeaponColumns(godRollSockets())
+	for hash, socket := range map[Hash]int{450: 0, 451: 1, 452: 1, 455: 3, 456: 4, 457: 3, 999: -1} {
+		if perk := columns.perk(hash); perk.Socket != socket {
+			t.Errorf("expected %s in socket %d, got %+v", hash, socket, perk)
+		}
+	}
+	if name := columns.perk(456).Name; name != "Threat Detector" {
+		t.Errorf("expected the perk name, got %q", name)
+	}
+	if category := columns.category(4); category != "perks" {
+		t.Errorf("expected the perks category for socket 4, got %q", category)
+	}
+}
+
+func TestGetGodRollSignedItem(t *testing.T) {
+	const weapon Hash = 3000000000
+	testManifest(t, fixtureTables{
+		itemTable: {
+			weapon: `{"displayProperties":{"name":"Fatebringer"},"sockets":{"socketEntries":[{"randomizedPlugSetHash":600}]}}`,
+			455:    `{"displayProperties":{"name":"Explosive Payload"}}`,
+			456:    `{"displayProperties":{"name":"Firefly"}}`,
+		},
+		plugSetTable: {600: `{"reusablePlugItems":[{"plugItemHash":455},{"plugItemHash":456}]}`},
+	})
+	store := testBuilds(t)
+	//one build keeps the weapon as bungie's signed id, the other as the hash
+	for name, item := range map[string]string{"Signed": fmt.Sprint(weapon.ID()), "Unsigned": weapon.String()} {
+		build := Class{Name: name, Slots: map[string]Slot{"kinetic": {Item: item, Lists: map[string][]string{"recomended_perks": {"456"}}}}}
+		if _, err := store.Create("warlock", "", build, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/destiny/items/{hash}/godroll", GetGodRoll).Methods("GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/destiny/items/"+weapon.String()+"/godroll?perks=456", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var evaluation RollEvaluation
+	if err := json.Unmarshal(w.Body.Bytes(), &evaluation); err != nil {
+		t.Fatal(err)
+	}
+	if len(evaluation.Builds) != 2 {
+		t.Fatalf("expected both builds to be scored, got %+v", evaluation.Builds)
+	}
+	for _, build := range evaluation.Builds {
+		if build.Score != 1 {
+			t.Errorf("expected %s to match the roll, got %+v", build.Name, build)
+		}
+	}
+}
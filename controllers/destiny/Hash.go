@@ -0,0 +1,56 @@
+package destiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hash is a bungie definition hash. Hashes are unsigned 32 bit numbers, while the world content
+// tables key their rows by the same bits read as a signed id, so anything above 2^31 shows up negative there.
+type Hash uint32
+
+// HashFromID turns the signed id of a world content row into its hash
+func HashFromID(id int64) Hash {
+	return Hash(uint32(int32(id)))
+}
+
+// ID is the signed id the world content tables use for this hash
+func (hash Hash) ID() int32 {
+	return int32(hash)
+}
+
+func (hash Hash) String() string {
+	return strconv.FormatUint(uint64(hash), 10)
+}
+
+// ParseHash reads a hash written either unsigned or as a signed id
+func ParseHash(value string) (Hash, error) {
+	value = strings.TrimSpace(value)
+	if unsigned, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return Hash(unsigned), nil
+	}
+	if signed, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return HashFromID(signed), nil
+	}
+	return 0, fmt.Errorf("invalid hash %q", value)
+}
+
+func (hash *Hash) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "null" || value == "" {
+		*hash = 0
+		return nil
+	}
+	parsed, err := ParseHash(value)
+	if err != nil {
+		return err
+	}
+	*hash = parsed
+	return nil
+}
+
+func (hash Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(uint32(hash))
+}
@@ -0,0 +1,273 @@
+package destiny
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"projector/controllers/functions"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	plugSetTable        = "DestinyPlugSetDefinition"
+	perkTable           = "DestinySandboxPerkDefinition"
+	socketCategoryTable = "DestinySocketCategoryDefinition"
+)
+
+// perks bungie marks as hidden are left out of the plugs
+const perkHidden = 2
+
+type PerkDetail struct {
+	Hash        Hash   `json:"hash"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+type PlugDetail struct {
+	Hash         Hash         `json:"hash"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	Icon         string       `json:"icon"`
+	PlugCategory string       `json:"plugCategory"`
+	CanRoll      bool         `json:"canRoll"`
+	Perks        []PerkDetail `json:"perks"`
+}
+
+// SocketDetail is a socket of an item with every plug that can go in it looked up
+type SocketDetail struct {
+	Index          int          `json:"index"`
+	Category       string       `json:"category"`
+	SocketTypeHash Hash         `json:"socketTypeHash"`
+	Initial        *PlugDetail  `json:"initial,omitempty"`
+	Reusable       []PlugDetail `json:"reusable"`
+	Randomized     []PlugDetail `json:"randomized"`
+}
+
+type ItemDetail struct {
+	Item    interface{}    `json:"item"`
+	Sockets []SocketDetail `json:"sockets"`
+}
+
+type plugSetEntry struct {
+	PlugItemHash     Hash  `json:"plugItemHash"`
+	CurrentlyCanRoll *bool `json:"currentlyCanRoll"`
+}
+
+type itemSockets struct {
+	Sockets struct {
+		SocketEntries []struct {
+			SocketTypeHash        Hash           `json:"socketTypeHash"`
+			SingleInitialItemHash Hash           `json:"singleInitialItemHash"`
+			ReusablePlugItems     []plugSetEntry `json:"reusablePlugItems"`
+			ReusablePlugSetHash   Hash           `json:"reusablePlugSetHash"`
+			RandomizedPlugSetHash Hash           `json:"randomizedPlugSetHash"`
+		} `json:"socketEntries"`
+		SocketCategories []struct {
+			SocketCategoryHash Hash  `json:"socketCategoryHash"`
+			SocketIndexes      []int `json:"socketIndexes"`
+		} `json:"socketCategories"`
+	} `json:"sockets"`
+}
+
+type displayDefinition struct {
+	DisplayProperties struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+	} `json:"displayProperties"`
+	Plug struct {
+		PlugCategoryIdentifier string `json:"plugCategoryIdentifier"`
+	} `json:"plug"`
+	Perks []struct {
+		PerkHash       Hash `json:"perkHash"`
+		PerkVisibility int  `json:"perkVisibility"`
+	} `json:"perks"`
+	ReusablePlugItems []plugSetEntry `json:"reusablePlugItems"`
+}
+
+// lookupDefinitions fetches and decodes the given hashes of a table, a table that wasn't imported
+// just leaves its part of the detail empty
+func lookupDefinitions(store *ManifestStore, table string, hashes []Hash) (map[Hash]displayDefinition, error) {
+	raw, err := store.GetMany(table, hashes)
+	if errors.Is(err, ErrUnknownTable) {
+		return map[Hash]displayDefinition{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make(map[Hash]displayDefinition, len(raw))
+	for hash, data := range raw {
+		var definition displayDefinition
+		if err := json.Unmarshal(data, &definition); err != nil {
+			return nil, &ManifestError{Table: table, Hash: hash, Err: err}
+		}
+		definitions[hash] = definition
+	}
+	return definitions, nil
+}
+
+// ExpandSockets resolves every socket of an item down to its plugs and their perks in four batched lookups
+func ExpandSockets(store *ManifestStore, raw json.RawMessage) ([]SocketDetail, error) {
+	var item itemSockets
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, err
+	}
+	entries := item.Sockets.SocketEntries
+
+	var plugSetHashes []Hash
+	for _, entry := range entries {
+		for _, hash := range []Hash{entry.ReusablePlugSetHash, entry.RandomizedPlugSetHash} {
+			if hash != 0 {
+				plugSetHashes = append(plugSetHashes, hash)
+			}
+		}
+	}
+	plugSets, err := lookupDefinitions(store, plugSetTable, plugSetHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugHashes []Hash
+	for _, entry := range entries {
+		plugHashes = append(plugHashes, entry.SingleInitialItemHash)
+		for _, plug := range entry.ReusablePlugItems {
+			plugHashes = append(plugHashes, plug.PlugItemHash)
+		}
+	}
+	for _, set := range plugSets {
+		for _, plug := range set.ReusablePlugItems {
+			plugHashes = append(plugHashes, plug.PlugItemHash)
+		}
+	}
+	plugs, err := lookupDefinitions(store, itemTable, plugHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var perkHashes []Hash
+	for _, plug := range plugs {
+		for _, perk := range plug.Perks {
+			perkHashes = append(perkHashes, perk.PerkHash)
+		}
+	}
+	perks, err := lookupDefinitions(store, perkTable, perkHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var categoryHashes []Hash
+	for _, category := range item.Sockets.SocketCategories {
+		categoryHashes = append(categoryHashes, category.SocketCategoryHash)
+	}
+	categories, err := lookupDefinitions(store, socketCategoryTable, categoryHashes)
+	if err != nil {
+		return nil, err
+	}
+	categoryOf := make(map[int]string)
+	for _, category := range item.Sockets.SocketCategories {
+		for _, index := range category.SocketIndexes {
+			categoryOf[index] = categories[category.SocketCategoryHash].DisplayProperties.Name
+		}
+	}
+
+	plugDetail := func(hash Hash, canRoll bool) PlugDetail {
+		plug := plugs[hash]
+		detail := PlugDetail{
+			Hash:         hash,
+			Name:         plug.DisplayProperties.Name,
+			Description:  plug.DisplayProperties.Description,
+			Icon:         plug.DisplayProperties.Icon,
+			PlugCategory: plug.Plug.PlugCategoryIdentifier,
+			CanRoll:      canRoll,
+			Perks:        make([]PerkDetail, 0, len(plug.Perks)),
+		}
+		for _, perk := range plug.Perks {
+			if perk.PerkVisibility == perkHidden {
+				continue
+			}
+			definition := perks[perk.PerkHash]
+			detail.Perks = append(detail.Perks, PerkDetail{
+				Hash:        perk.PerkHash,
+				Name:        definition.DisplayProperties.Name,
+				Description: definition.DisplayProperties.Description,
+				Icon:        definition.DisplayProperties.Icon,
+			})
+		}
+		return detail
+	}
+
+	//plug sets list a plug once per way it can drop, only its first appearance is kept
+	plugList := func(entries ...[]plugSetEntry) []PlugDetail {
+		list := make([]PlugDetail, 0)
+		seen := make(map[Hash]int)
+		for _, set := range entries {
+			for _, entry := range set {
+				canRoll := entry.CurrentlyCanRoll == nil || *entry.CurrentlyCanRoll
+				if index, ok := seen[entry.PlugItemHash]; ok {
+					list[index].CanRoll = list[index].CanRoll || canRoll
+					continue
+				}
+				seen[entry.PlugItemHash] = len(list)
+				list = append(list, plugDetail(entry.PlugItemHash, canRoll))
+			}
+		}
+		return list
+	}
+
+	sockets := make([]SocketDetail, 0, len(entries))
+	for index, entry := range entries {
+		socket := SocketDetail{
+			Index:          index,
+			Category:       categoryOf[index],
+			SocketTypeHash: entry.SocketTypeHash,
+			Reusable:       plugList(entry.ReusablePlugItems, plugSets[entry.ReusablePlugSetHash].ReusablePlugItems),
+			Randomized:     plugList(plugSets[entry.RandomizedPlugSetHash].ReusablePlugItems),
+		}
+		if entry.SingleInitialItemHash != 0 {
+			initial := plugDetail(entry.SingleInitialItemHash, true)
+			socket.Initial = &initial
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets, nil
+}
+
+// GetItemDetail answers with an item and its sockets expanded down to plugs and perks
+func GetItemDetail(w http.ResponseWriter, router *http.Request) {
+	hash, err := ParseHash(mux.Vars(router)["hash"])
+	if err != nil {
+		functions.WriteError(w, functions.BadRequest(err.Error()))
+		return
+	}
+
+	store := Manifest.Store(Language(router))
+	raw, err := store.GetRaw(itemTable, hash)
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+
+	var detail ItemDetail
+	if fields := ParseFields(router); len(fields) > 0 {
+		detail.Item, err = ProjectFields(raw, fields)
+	} else {
+		var item Item
+		err = json.Unmarshal(raw, &item)
+		detail.Item = item
+	}
+	if err != nil {
+		functions.WriteError(w, functions.Internal("Unable to read the destiny manifest", err))
+		return
+	}
+
+	if detail.Sockets, err = ExpandSockets(store, raw); err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
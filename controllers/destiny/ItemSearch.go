@@ -0,0 +1,274 @@
+package destiny
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const searchTable = "ItemSearch"
+
+// ErrNoSearchIndex is returned when the manifest was generated without the search index,
+// sqlite has to be built with the sqlite_fts5 tag for it
+var ErrNoSearchIndex = errors.New("the manifest has no item search index")
+
+// ItemTypes are the names the type filter takes besides an itemTypeDisplayName like Hand Cannon
+var ItemTypes = map[string]int{
+	"armor":    2,
+	"weapon":   3,
+	"subclass": 16,
+	"mod":      19,
+	"ghost":    24,
+	"emblem":   14,
+}
+
+// buildSearchIndex fills an fts5 table with the searchable text of every named item
+func buildSearchIndex(db *sql.DB) error {
+	_, err := db.Exec("DROP TABLE IF EXISTS `" + searchTable + "`;" +
+		"CREATE VIRTUAL TABLE `" + searchTable + "` USING fts5(" +
+		"hash UNINDEXED, name, description, type, flavor, " +
+		"item_type UNINDEXED, tier UNINDEXED, class_type UNINDEXED, icon UNINDEXED, " +
+		"tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3');")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT hash, json FROM `" + itemTable + "`")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	insert, err := tx.Prepare("INSERT INTO `" + searchTable + "` (hash, name, description, type, flavor, item_type, tier, class_type, icon) VALUES (?,?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for rows.Next() {
+		var hash, jsondata string
+		if err := rows.Scan(&hash, &jsondata); err != nil {
+			return err
+		}
+
+		var item struct {
+			DisplayProperties struct {
+				Name        string `json:"name"`
+				Description string `json:"description"`
+				Icon        string `json:"icon"`
+			} `json:"displayProperties"`
+			ItemTypeDisplayName string `json:"itemTypeDisplayName"`
+			FlavorText          string `json:"flavorText"`
+			ItemType            int    `json:"itemType"`
+			ClassType           int    `json:"classType"`
+			Inventory           struct {
+				TierTypeName string `json:"tierTypeName"`
+			} `json:"inventory"`
+		}
+		if err := json.Unmarshal([]byte(jsondata), &item); err != nil {
+			return fmt.Errorf("unable to read item %s: %w", hash, err)
+		}
+		//plenty of definitions are unnamed placeholders nobody searches for
+		if strings.TrimSpace(item.DisplayProperties.Name) == "" {
+			continue
+		}
+
+		_, err := insert.Exec(hash, item.DisplayProperties.Name, item.DisplayProperties.Description, item.ItemTypeDisplayName,
+			item.FlavorText, item.ItemType, item.Inventory.TierTypeName, item.ClassType, item.DisplayProperties.Icon)
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isMissingFTS5 tells whether sqlite was built without fts5
+func isMissingFTS5(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such module: fts5")
+}
+
+type SearchQuery struct {
+	Text   string
+	Type   string
+	Tier   string
+	Class  string
+	Limit  int
+	Offset int
+}
+
+type SearchResult struct {
+	Hash        Hash   `json:"hash"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Tier        string `json:"tier"`
+	ClassType   int    `json:"classType"`
+	Icon        string `json:"icon"`
+}
+
+// matchExpression turns what was typed into an fts5 query, every word has to match as a prefix.
+// Words are split where the unicode61 tokenizer splits them, so Nezarec's looks for nezarec and s.
+func matchExpression(text string) string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		terms = append(terms, `"`+word+`"*`)
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	return "{name description type flavor} : (" + strings.Join(terms, " ") + ")"
+}
+
+// Search finds items whose text matches the query, best matches first, names weigh the most
+func (store *ManifestStore) Search(query SearchQuery) ([]SearchResult, int, error) {
+	match := matchExpression(query.Text)
+	if match == "" {
+		return []SearchResult{}, 0, nil
+	}
+
+	where := "`" + searchTable + "` MATCH ?"
+	args := []interface{}{match}
+	if query.Type != "" {
+		if itemType, ok := ItemTypes[strings.ToLower(query.Type)]; ok {
+			where += " AND item_type = ?"
+			args = append(args, itemType)
+		} else {
+			where += " AND type = ? COLLATE NOCASE"
+			args = append(args, query.Type)
+		}
+	}
+	if query.Tier != "" {
+		where += " AND tier = ? COLLATE NOCASE"
+		args = append(args, query.Tier)
+	}
+	if query.Class != "" {
+		classType, ok := ClassTypes[strings.ToLower(query.Class)]
+		if !ok {
+			return nil, 0, functions.BadRequest(fmt.Sprintf("Unknown class %q, expected titan, hunter or warlock", query.Class))
+		}
+		//items any class can use come along
+		where += " AND class_type IN (?, 3)"
+		args = append(args, classType)
+	}
+
+	if err := store.acquire(); err != nil {
+		return nil, 0, &ManifestError{Table: searchTable, Err: err}
+	}
+	defer store.mu.RUnlock()
+
+	var total int
+	err := store.db.QueryRow("SELECT count(*) FROM `"+searchTable+"` WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, 0, ErrNoSearchIndex
+		}
+		return nil, 0, &ManifestError{Table: searchTable, Err: err}
+	}
+
+	rows, err := store.db.Query("SELECT hash, name, description, type, tier, class_type, icon FROM `"+searchTable+"` WHERE "+where+
+		" ORDER BY bm25(`"+searchTable+"`, 0, 10, 1, 4, 0.5) LIMIT ? OFFSET ?", append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, &ManifestError{Table: searchTable, Err: err}
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0, query.Limit)
+	for rows.Next() {
+		var result SearchResult
+		var hash string
+		if err := rows.Scan(&hash, &result.Name, &result.Description, &result.Type, &result.Tier, &result.ClassType, &result.Icon); err != nil {
+			return nil, 0, &ManifestError{Table: searchTable, Err: err}
+		}
+		result.Hash, _ = ParseHash(hash)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, &ManifestError{Table: searchTable, Err: err}
+	}
+	return results, total, nil
+}
+
+// intParam reads a non negative number parameter, falling back to def when it's not given
+func intParam(router *http.Request, name string, def int) (int, error) {
+	value := router.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, functions.BadRequest(name + " has to be a number from 0")
+	}
+	return number, nil
+}
+
+func SearchItems(w http.ResponseWriter, router *http.Request) {
+	query := router.URL.Query()
+	search := SearchQuery{Text: query.Get("q"), Type: query.Get("type"), Tier: query.Get("tier"), Class: query.Get("class")}
+
+	var err error
+	if search.Limit, err = intParam(router, "limit", 20); err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	if search.Offset, err = intParam(router, "offset", 0); err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	if search.Limit == 0 {
+		search.Limit = 20
+	}
+	if search.Limit > 100 {
+		search.Limit = 100
+	}
+
+	results, total, err := Manifest.Store(Language(router)).Search(search)
+	var httpErr *functions.Error
+	if errors.As(err, &httpErr) {
+		functions.WriteError(w, err)
+		return
+	}
+	if errors.Is(err, ErrNoSearchIndex) {
+		functions.WriteError(w, &functions.Error{Status: http.StatusServiceUnavailable, Code: "search_unavailable", Message: "Item search is not available on this server", Err: err})
+		return
+	}
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+
+	for i := range results {
+		if results[i].Icon != "" {
+			results[i].Icon = Manifest.BaseURL + results[i].Icon
+		}
+	}
+
+	page := map[string]interface{}{
+		"results": results,
+		"total":   total,
+		"limit":   search.Limit,
+		"offset":  search.Offset,
+	}
+	if next := search.Offset + len(results); next < total {
+		page["nextOffset"] = next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,167 @@
+package destiny
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchExpression(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "gjall", want: `{name description type flavor} : ("gjall"*)`},
+		{text: "  Ace of  Spades ", want: `{name description type flavor} : ("Ace"* "of"* "Spades"*)`},
+		{text: `Nezarec's "Sin"`, want: `{name description type flavor} : ("Nezarec"* "s"* "Sin"*)`},
+		{text: "Saint-14 (helm) OR NOT*", want: `{name description type flavor} : ("Saint"* "14"* "helm"* "OR"* "NOT"*)`},
+		{text: "Sunbracers: ''", want: `{name description type flavor} : ("Sunbracers"*)`},
+		{text: `" - * ( ) :`, want: ""},
+		{text: "", want: ""},
+	}
+	for _, test := range tests {
+		if got := matchExpression(test.text); got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.text, test.want, got)
+		}
+	}
+}
+
+// requireFTS5 skips tests of the search index when sqlite is built without the sqlite_fts5 tag
+func requireFTS5(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE VIRTUAL TABLE probe USING fts5(text)"); isMissingFTS5(err) {
+		t.Skip("sqlite is built without fts5")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// searchManifest has a few weapons and armor pieces of every class and tier to filter between
+func searchManifest(t *testing.T) *ManifestStore {
+	item := func(name, kind, tier string, itemType, classType int) string {
+		return fmt.Sprintf(`{"displayProperties":{"name":%q,"description":"From the armory"},"itemTypeDisplayName":%q,`+
+			`"itemType":%d,"classType":%d,"inventory":{"tierTypeName":%q}}`, name, kind, itemType, classType, tier)
+	}
+	return testManifest(t, fixtureTables{itemTable: {
+		400: item("Gjallarhorn", "Rocket Launcher", "Exotic", 3, 3),
+		401: item("Gjallarhorn Catalyst", "Catalyst", "Common", 0, 3),
+		402: item("Funnelweb", "Submachine Gun", "Legendary", 3, 3),
+		410: item("Nezarec's Sin", "Helmet", "Exotic", 2, 2),
+		411: item("Helm of Saint-14", "Helmet", "Exotic", 2, 0),
+		412: item("Gjallarwing", "Helmet", "Legendary", 2, 1),
+		413: item("Gjallar Cloak", "Hunter Cloak", "Legendary", 2, 1),
+		//unnamed placeholders stay out of the index
+		499: `{"displayProperties":{"name":""},"itemTypeDisplayName":"Rocket Launcher"}`,
+	}}).Store(DefaultManifestLocale)
+}
+
+func TestSearch(t *testing.T) {
+	requireFTS5(t)
+	store := searchManifest(t)
+
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  []Hash
+	}{
+		{name: "prefix", query: SearchQuery{Text: "gjall"}, want: []Hash{400, 401, 412, 413}},
+		{name: "every word", query: SearchQuery{Text: "gjall cat"}, want: []Hash{401}},
+		{name: "apostrophes", query: SearchQuery{Text: "nezarec's"}, want: []Hash{410}},
+		{name: "apostrophes left out", query: SearchQuery{Text: "nezarec sin"}, want: []Hash{410}},
+		{name: "named type", query: SearchQuery{Text: "gjall", Type: "weapon"}, want: []Hash{400}},
+		{name: "display type", query: SearchQuery{Text: "gjall", Type: "hunter cloak"}, want: []Hash{413}},
+		{name: "tier", query: SearchQuery{Text: "gjall", Tier: "legendary"}, want: []Hash{412, 413}},
+		{name: "class with the items any class uses", query: SearchQuery{Text: "helm", Class: "titan"}, want: []Hash{411}},
+		{name: "class", query: SearchQuery{Text: "armory", Class: "Hunter", Type: "armor"}, want: []Hash{412, 413}},
+		{name: "no words", query: SearchQuery{Text: "--"}, want: []Hash{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.query.Limit = 20
+			results, total, err := store.Search(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[Hash]bool)
+			for _, result := range results {
+				found[result.Hash] = true
+			}
+			if total != len(test.want) || len(found) != len(test.want) {
+				t.Errorf("expected %v, got %+v of %d", test.want, results, total)
+			}
+			for _, hash := range test.want {
+				if !found[hash] {
+					t.Errorf("expected %s in %+v", hash, results)
+				}
+			}
+		})
+	}
+
+	if _, _, err := store.Search(SearchQuery{Text: "gjall", Class: "guardian", Limit: 20}); err == nil {
+		t.Errorf("expected an unknown class to be refused")
+	}
+}
+
+func TestSearchItemsPages(t *testing.T) {
+	requireFTS5(t)
+	searchManifest(t)
+
+	seen := make(map[Hash]bool)
+	offset := "0"
+	for pages := 0; offset != ""; pages++ {
+		if pages > 2 {
+			t.Fatalf("expected two pages, still paging at offset %s", offset)
+		}
+		w := httptest.NewRecorder()
+		SearchItems(w, httptest.NewRequest("GET", "/api/destiny/items/search?q=gjall&limit=3&offset="+offset, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var page struct {
+			Results    []SearchResult `json:"results"`
+			Total      int            `json:"total"`
+			NextOffset *int           `json:"nextOffset"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 4 {
+			t.Errorf("expected a total of 4 on every page, got %d", page.Total)
+		}
+		for _, result := range page.Results {
+			if seen[result.Hash] {
+				t.Errorf("%s came up on two pages", result.Hash)
+			}
+			seen[result.Hash] = true
+		}
+
+		offset = ""
+		if page.NextOffset != nil {
+			offset = fmt.Sprint(*page.NextOffset)
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("expected the four matches over the pages, got %v", seen)
+	}
+}
+
+func TestSearchItemsWithoutIndex(t *testing.T) {
+	//a manifest without the item table has no index, the same as one generated without fts5
+	testManifest(t, fixtureTables{plugSetTable: {600: `{"reusablePlugItems":[]}`}})
+
+	w := httptest.NewRecorder()
+	SearchItems(w, httptest.NewRequest("GET", "/api/destiny/items/search?q=gjall", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a search index, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,100 @@
+package destiny
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultManifestLocale is served whenever the requested language isn't downloaded
+const DefaultManifestLocale = "en"
+
+// WorldContentPath returns the mobile world content path for one of bungie's locales
+func (data ManifestURL) WorldContentPath(lang string) string {
+	paths := data.Response.MobileWorldContentPaths
+	switch lang {
+	case "en":
+		return paths.En
+	case "fr":
+		return paths.Fr
+	case "es":
+		return paths.Es
+	case "es-mx":
+		return paths.EsMx
+	case "de":
+		return paths.De
+	case "it":
+		return paths.It
+	case "ja":
+		return paths.Ja
+	case "pt-br":
+		return paths.PtBr
+	case "ru":
+		return paths.Ru
+	case "pl":
+		return paths.Pl
+	case "ko":
+		return paths.Ko
+	case "zh-cht":
+		return paths.ZhCht
+	case "zh-chs":
+		return paths.ZhChs
+	}
+	return ""
+}
+
+// browser language tags that don't match bungie's locale names
+var localeAliases = map[string]string{
+	"zh":      "zh-chs",
+	"zh-cn":   "zh-chs",
+	"zh-sg":   "zh-chs",
+	"zh-hans": "zh-chs",
+	"zh-tw":   "zh-cht",
+	"zh-hk":   "zh-cht",
+	"zh-hant": "zh-cht",
+	"pt":      "pt-br",
+}
+
+// Language picks the manifest locale for a request from ?lang= or Accept-Language, falling back to english
+func Language(router *http.Request) string {
+	available := Manifest.Available()
+
+	if lang := matchLocale(router.URL.Query().Get("lang"), available); lang != "" {
+		return lang
+	}
+
+	//Accept-Language is ordered by preference often enough that the q weights can be ignored
+	for _, part := range strings.Split(router.Header.Get("Accept-Language"), ",") {
+		tag := strings.SplitN(part, ";", 2)[0]
+		if lang := matchLocale(tag, available); lang != "" {
+			return lang
+		}
+	}
+	return DefaultManifestLocale
+}
+
+func matchLocale(tag string, available []string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return ""
+	}
+
+	candidates := []string{tag}
+	if alias, ok := localeAliases[tag]; ok {
+		candidates = append(candidates, alias)
+	}
+	if base := strings.SplitN(tag, "-", 2)[0]; base != tag {
+		candidates = append(candidates, base)
+		if alias, ok := localeAliases[base]; ok {
+			candidates = append(candidates, alias)
+		}
+	}
+
+	for _, candidate := range candidates {
+		for _, lang := range available {
+			if candidate == lang {
+				return lang
+			}
+		}
+	}
+	return ""
+}
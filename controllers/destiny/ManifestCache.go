@@ -0,0 +1,137 @@
+package destiny
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// DefaultCacheSize is how many definitions are kept in memory across all tables and locales
+const DefaultCacheSize = 5000
+
+type cacheKey struct {
+	Table string
+	Hash  Hash
+	Lang  string
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	raw  json.RawMessage
+	item *Item
+}
+
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ManifestCache is a size bounded LRU of definitions in front of the manifest stores
+type ManifestCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[cacheKey]*list.Element
+	stats    CacheStats
+}
+
+func NewManifestCache(capacity int) *ManifestCache {
+	return &ManifestCache{capacity: capacity, order: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+func (cache *ManifestCache) get(key cacheKey) (cacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.stats.Misses++
+		return cacheEntry{}, false
+	}
+	cache.stats.Hits++
+	cache.order.MoveToFront(element)
+	return *element.Value.(*cacheEntry), true
+}
+
+func (cache *ManifestCache) add(key cacheKey, raw json.RawMessage) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*cacheEntry).raw = raw
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&cacheEntry{key: key, raw: raw})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		cache.stats.Evictions++
+	}
+}
+
+// decoded keeps the unmarshalled item next to its json, an entry purged or reloaded in the meantime is left alone
+func (cache *ManifestCache) decoded(key cacheKey, raw json.RawMessage, item Item) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.entries[key]; ok && sameJSON(element.Value.(*cacheEntry).raw, raw) {
+		element.Value.(*cacheEntry).item = &item
+	}
+}
+
+// item returns the item decoded from exactly this json, without counting as a lookup
+// since the json itself was just fetched through get
+func (cache *ManifestCache) item(key cacheKey, raw json.RawMessage) (*Item, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.item == nil || !sameJSON(entry.raw, raw) {
+		return nil, false
+	}
+	return entry.item, true
+}
+
+// sameJSON tells whether both are the very same bytes read from the database, not just equal ones
+func sameJSON(a, b json.RawMessage) bool {
+	return len(a) > 0 && len(a) == len(b) && &a[0] == &b[0]
+}
+
+// Purge drops every cached definition of a locale, used once a new manifest is swapped in
+func (cache *ManifestCache) Purge(lang string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for key, element := range cache.entries {
+		if key.Lang == lang {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+}
+
+func (cache *ManifestCache) Stats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	stats := cache.stats
+	stats.Size = cache.order.Len()
+	stats.Capacity = cache.capacity
+	return stats
+}
+
+func GetCacheStats(w http.ResponseWriter, router *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Manifest.Cache().Stats())
+}
@@ -0,0 +1,65 @@
+package destiny
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolverReusesDecodedItems(t *testing.T) {
+	service := testManifest(t, fixtureTables{itemTable: {
+		1001: `{"displayProperties":{"name":"Gjallarhorn"}}`,
+	}})
+	store := service.Store(DefaultManifestLocale)
+	key := cacheKey{Table: itemTable, Hash: 1001, Lang: DefaultManifestLocale}
+
+	first, err := newItemResolver(store, []string{"1001"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.resolve("1001"); err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := store.cache.item(key, first.items[1001])
+	if !ok || decoded.DisplayProperties.Name != "Gjallarhorn" {
+		t.Fatalf("expected the decoded item to be cached, got %v %v", decoded, ok)
+	}
+
+	second, err := newItemResolver(store, []string{"1001"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected the second request to be a cache hit, got %+v", stats)
+	}
+	item, err := second.resolve("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.(Item).DisplayProperties.Name != "Gjallarhorn" {
+		t.Errorf("unexpected item %+v", item)
+	}
+	if again, _ := store.cache.item(key, second.items[1001]); again != decoded {
+		t.Errorf("expected the same decoded item to be reused")
+	}
+}
+
+func TestDecodedItemFollowsItsJSON(t *testing.T) {
+	cache := NewManifestCache(2)
+	key := cacheKey{Table: itemTable, Hash: 1, Lang: "en"}
+
+	old := json.RawMessage(`{"displayProperties":{"name":"Old"}}`)
+	cache.add(key, old)
+	cache.decoded(key, old, Item{})
+
+	//a new manifest replaced the json, the item decoded from the old one must not be handed out
+	fresh := json.RawMessage(`{"displayProperties":{"name":"New"}}`)
+	cache.Purge("en")
+	cache.add(key, fresh)
+	if _, ok := cache.item(key, fresh); ok {
+		t.Errorf("the item decoded from the old json was kept")
+	}
+	cache.decoded(key, old, Item{})
+	if _, ok := cache.item(key, fresh); ok {
+		t.Errorf("an item decoded from stale json was attached to the new entry")
+	}
+}
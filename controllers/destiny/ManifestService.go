@@ -0,0 +1,276 @@
+package destiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultManifestTables are the definition tables copied into manifest.db
+var DefaultManifestTables = []string{
+	"DestinyInventoryItemDefinition",
+	"DestinySandboxPerkDefinition",
+	"DestinyStatDefinition",
+	"DestinyStatGroupDefinition",
+	"DestinySocketTypeDefinition",
+	"DestinySocketCategoryDefinition",
+	"DestinyPlugSetDefinition",
+	"DestinyDamageTypeDefinition",
+	"DestinyClassDefinition",
+	"DestinyInventoryBucketDefinition",
+	"DestinyCollectibleDefinition",
+	"DestinyActivityDefinition",
+}
+
+// ManifestSchema is the layout GenerateManifest writes, it is kept next to bungie's version on disk.
+// Bump it whenever that layout changes, like the ItemSearch table did, so a deployment that already
+// has bungie's current version regenerates its databases on the next check.
+const ManifestSchema = 2
+
+// DefaultManifestLocales are the languages downloaded, each into its own database
+var DefaultManifestLocales = []string{"en"}
+
+type ManifestStatus struct {
+	Version    string    `json:"version"`
+	Schema     int       `json:"schema"`
+	Locales    []string  `json:"locales"`
+	LastCheck  time.Time `json:"lastCheck"`
+	LastUpdate time.Time `json:"lastUpdate"`
+	LastError  string    `json:"lastError"`
+}
+
+// ManifestService keeps manifest.db in line with the manifest version bungie is serving
+type ManifestService struct {
+	Dir      string
+	BaseURL  string
+	Interval time.Duration
+	Tables   []string
+	Locales  []string
+	//CacheSize bounds the definitions kept in memory, DefaultCacheSize when zero
+	CacheSize int
+
+	updating sync.Mutex
+	mu       sync.RWMutex
+	status   ManifestStatus
+	stores   map[string]*ManifestStore
+	cache    *ManifestCache
+	ready    chan struct{}
+	once     sync.Once
+}
+
+var Manifest = &ManifestService{
+	Dir:      "./controllers/destiny/manifest",
+	BaseURL:  "https://www.bungie.net",
+	Interval: time.Hour,
+	Tables:   DefaultManifestTables,
+	Locales:  DefaultManifestLocales,
+}
+
+// Start loads the version on disk and keeps checking bungie for a new one in the background
+func (service *ManifestService) Start() {
+	service.load()
+
+	ready := service.readyChan()
+	go func() {
+		for {
+			if err := service.Check(); err != nil {
+				log.Println("Unable to update the destiny manifest:", err)
+			}
+			service.once.Do(func() { close(ready) })
+			time.Sleep(service.Interval)
+		}
+	}()
+}
+
+// load reads the version and schema the databases on disk were generated with.
+// Databases from before the schema was written down count as schema 0.
+func (service *ManifestService) load() {
+	version, err := ioutil.ReadFile(filepath.Join(service.Dir, "version"))
+	if err != nil {
+		return
+	}
+	schema, _ := ioutil.ReadFile(filepath.Join(service.Dir, "schema"))
+	number, _ := strconv.Atoi(strings.TrimSpace(string(schema)))
+
+	service.mu.Lock()
+	service.status.Version = strings.TrimSpace(string(version))
+	service.status.Schema = number
+	service.status.Locales = service.downloaded()
+	service.mu.Unlock()
+}
+
+// Check downloads and swaps in new manifest databases when bungie reports a version other than the current one
+func (service *ManifestService) Check() error {
+	service.updating.Lock()
+	defer service.updating.Unlock()
+
+	err := service.update()
+
+	service.mu.Lock()
+	service.status.LastCheck = time.Now()
+	service.status.LastError = ""
+	if err != nil {
+		service.status.LastError = err.Error()
+	}
+	service.mu.Unlock()
+
+	return err
+}
+
+func (service *ManifestService) update() error {
+	body, err := bungieGet(service.BaseURL + "/Platform/Destiny2/Manifest/")
+	if err != nil {
+		return err
+	}
+
+	var data ManifestURL
+	if err := json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("unable to read the manifest urls: %w", err)
+	}
+	version := data.Response.Version
+	if version == "" {
+		return fmt.Errorf("bungie did not report a manifest version")
+	}
+	locales := service.locales()
+	status := service.Status()
+	if version == status.Version && status.Schema == ManifestSchema && len(service.downloaded()) == len(locales) {
+		return nil
+	}
+
+	tables := service.Tables
+	if len(tables) == 0 {
+		tables = DefaultManifestTables
+	}
+
+	for _, lang := range locales {
+		path := data.WorldContentPath(lang)
+		if path == "" {
+			return fmt.Errorf("bungie has no world content for locale %q", lang)
+		}
+
+		archive, err := bungieGet(service.BaseURL + path)
+		if err != nil {
+			return err
+		}
+		if err := GenerateManifest(archive, service.Path(lang), tables); err != nil {
+			return fmt.Errorf("unable to generate the %s manifest: %w", lang, err)
+		}
+		service.Store(lang).Reopen()
+	}
+	if err := ioutil.WriteFile(filepath.Join(service.Dir, "version"), []byte(version), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(service.Dir, "schema"), []byte(strconv.Itoa(ManifestSchema)), 0644); err != nil {
+		return err
+	}
+
+	service.mu.Lock()
+	service.status.Version = version
+	service.status.Schema = ManifestSchema
+	service.status.Locales = locales
+	service.status.LastUpdate = time.Now()
+	service.mu.Unlock()
+
+	log.Println("Destiny manifest updated to", version)
+	return nil
+}
+
+// Ready is closed once Start's first check is done, whether or not it managed to download anything
+func (service *ManifestService) Ready() <-chan struct{} {
+	return service.readyChan()
+}
+
+func (service *ManifestService) readyChan() chan struct{} {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.ready == nil {
+		service.ready = make(chan struct{})
+	}
+	return service.ready
+}
+
+// Path is where the database for the given locale lives
+func (service *ManifestService) Path(lang string) string {
+	return filepath.Join(service.Dir, "manifest_"+lang+".db")
+}
+
+// Store returns the long lived store for a locale's database
+func (service *ManifestService) Store(lang string) *ManifestStore {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.stores == nil {
+		service.stores = make(map[string]*ManifestStore)
+	}
+	store, ok := service.stores[lang]
+	if !ok {
+		tables := service.Tables
+		if len(tables) == 0 {
+			tables = DefaultManifestTables
+		}
+		store = NewManifestStore(service.Path(lang), lang, tables)
+		store.cache = service.cacheLocked()
+		service.stores[lang] = store
+	}
+	return store
+}
+
+// Cache returns the definition cache shared by every locale's store
+func (service *ManifestService) Cache() *ManifestCache {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.cacheLocked()
+}
+
+func (service *ManifestService) cacheLocked() *ManifestCache {
+	if service.cache == nil {
+		size := service.CacheSize
+		if size <= 0 {
+			size = DefaultCacheSize
+		}
+		service.cache = NewManifestCache(size)
+	}
+	return service.cache
+}
+
+// Available lists the languages that have a database ready to serve
+func (service *ManifestService) Available() []string {
+	return service.Status().Locales
+}
+
+func (service *ManifestService) locales() []string {
+	if len(service.Locales) == 0 {
+		return DefaultManifestLocales
+	}
+	return service.Locales
+}
+
+// downloaded lists the configured locales whose database is on disk
+func (service *ManifestService) downloaded() []string {
+	var locales []string
+	for _, lang := range service.locales() {
+		if _, err := os.Stat(service.Path(lang)); err == nil {
+			locales = append(locales, lang)
+		}
+	}
+	return locales
+}
+
+func (service *ManifestService) Status() ManifestStatus {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	return service.status
+}
+
+func GetManifestStatus(w http.ResponseWriter, router *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Manifest.Status())
+}
@@ -0,0 +1,83 @@
+package destiny
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fakeBungie serves a manifest version and its english world content, counting the downloads
+func fakeBungie(t *testing.T, version string, content []byte) (*httptest.Server, *int) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/Platform/Destiny2/Manifest/":
+			w.Write([]byte(`{"Response":{"version":"` + version + `","mobileWorldContentPaths":{"en":"/content/en.zip"}}}`))
+		case "/content/en.zip":
+			downloads++
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &downloads
+}
+
+func newTestService(t *testing.T, dir, baseURL string) *ManifestService {
+	service := &ManifestService{Dir: dir, BaseURL: baseURL, Tables: []string{itemTable}, Locales: []string{DefaultManifestLocale}}
+	t.Cleanup(func() {
+		for _, store := range service.stores {
+			store.Close()
+		}
+	})
+	return service
+}
+
+func TestManifestRegeneratesOnSchemaChange(t *testing.T) {
+	content := worldContent(t, fixtureTables{itemTable: {1001: `{"displayProperties":{"name":"Gjallarhorn"}}`}})
+	server, downloads := fakeBungie(t, "v1", content)
+	dir := t.TempDir()
+
+	service := newTestService(t, dir, server.URL)
+	service.load()
+	if err := service.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if *downloads != 1 {
+		t.Errorf("expected one download for an unchanged version and schema, got %d", *downloads)
+	}
+	if status := service.Status(); status.Version != "v1" || status.Schema != ManifestSchema {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	//a deployment from before the schema was written down, or from an older schema, has to regenerate
+	for _, old := range []string{"", strconv.Itoa(ManifestSchema - 1)} {
+		if old == "" {
+			os.Remove(filepath.Join(dir, "schema"))
+		} else if err := ioutil.WriteFile(filepath.Join(dir, "schema"), []byte(old), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		before := *downloads
+		restarted := newTestService(t, dir, server.URL)
+		restarted.load()
+		if err := restarted.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if *downloads != before+1 {
+			t.Errorf("schema %q: expected the manifest to be generated again", old)
+		}
+		schema, _ := ioutil.ReadFile(filepath.Join(dir, "schema"))
+		if string(schema) != strconv.Itoa(ManifestSchema) || restarted.Status().Schema != ManifestSchema {
+			t.Errorf("schema %q: expected schema %d to be written down, got %q", old, ManifestSchema, schema)
+		}
+	}
+}
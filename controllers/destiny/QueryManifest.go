@@ -3,6 +3,13 @@ package destiny
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"projector/controllers/functions"
+	"strings"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,34 +23,333 @@ type Data struct {
 	Json string `json:"json"`
 }
 
-type Message struct {
-	Type     string `json:"type"`
-	Response string `json:"response"`
+const itemTable = "DestinyInventoryItemDefinition"
+
+// ErrNotFound is wrapped by every lookup of a hash the manifest doesn't have
+var ErrNotFound = errors.New("not found in the destiny manifest")
+
+// ErrUnknownTable is wrapped when a table outside the imported ones is asked for
+var ErrUnknownTable = errors.New("unknown manifest table")
+
+// ManifestError tells which lookup failed, check it with errors.Is against ErrNotFound or ErrUnknownTable,
+// anything else is the database failing
+type ManifestError struct {
+	Table string
+	Hash  Hash
+	Err   error
+}
+
+func (e *ManifestError) Error() string {
+	if e.Hash != 0 {
+		return fmt.Sprintf("%s %s: %v", e.Table, e.Hash, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Table, e.Err)
+}
+
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+// ManifestStore serves definitions out of one locale's manifest database over a long lived connection pool
+type ManifestStore struct {
+	Lang   string
+	path   string
+	tables []string
+
+	mu    sync.RWMutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+	cache *ManifestCache
+}
+
+func NewManifestStore(path, lang string, tables []string) *ManifestStore {
+	return &ManifestStore{Lang: lang, path: path, tables: tables}
+}
+
+// acquire read locks the store with the connection open, the caller releases it with mu.RUnlock
+func (store *ManifestStore) acquire() error {
+	for {
+		store.mu.RLock()
+		if store.db != nil {
+			return nil
+		}
+		store.mu.RUnlock()
+
+		if err := store.open(); err != nil {
+			return err
+		}
+	}
+}
+
+// open connects to the database and prepares the lookups of every table
+func (store *ManifestStore) open() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.db != nil {
+		return nil
+	}
+
+	if _, err := os.Stat(store.path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+store.path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+
+	stmts := make(map[string]*sql.Stmt, len(store.tables))
+	for _, table := range store.tables {
+		stmt, err := db.Prepare("SELECT json FROM `" + table + "` WHERE hash = ?")
+		if err != nil {
+			db.Close()
+			return err
+		}
+		stmts[table] = stmt
+	}
+
+	store.db, store.stmts = db, stmts
+	return nil
+}
+
+// Reopen drops the connection and the cached definitions so the next lookup reads the database that was just swapped in
+func (store *ManifestStore) Reopen() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.cache != nil {
+		store.cache.Purge(store.Lang)
+	}
+	return store.close()
+}
+
+// cached looks a definition up in the cache, a store without one always misses
+func (store *ManifestStore) cached(table string, hash Hash) (cacheEntry, bool) {
+	if store.cache == nil {
+		return cacheEntry{}, false
+	}
+	return store.cache.get(cacheKey{Table: table, Hash: hash, Lang: store.Lang})
+}
+
+// remember caches a definition read from the database, called with the store locked
+// so a Reopen can't purge the cache between the read and the add
+func (store *ManifestStore) remember(table string, hash Hash, raw json.RawMessage) {
+	if store.cache != nil {
+		store.cache.add(cacheKey{Table: table, Hash: hash, Lang: store.Lang}, raw)
+	}
+}
+
+func (store *ManifestStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.close()
+}
+
+func (store *ManifestStore) close() error {
+	if store.db == nil {
+		return nil
+	}
+	for _, stmt := range store.stmts {
+		stmt.Close()
+	}
+	err := store.db.Close()
+	store.db, store.stmts = nil, nil
+	return err
 }
 
-func DestinyManifestQuery(id, tablename string) (Message, Item) {
-	db, error := sql.Open("sqlite3", "./controllers/destiny/manifest/manifest.db")
-	if error != nil {
-		m := Message{Type: "Error", Response: "Unable to load destiny manifest file"}
-		return m, Item{}
+func (store *ManifestStore) allowed(table string) bool {
+	for _, name := range store.tables {
+		if name == table {
+			return true
+		}
 	}
+	return false
+}
 
-	rows, error := db.Query("SELECT * FROM " + tablename + " WHERE hash='" + id + "';")
-	if error != nil {
+// GetRaw returns the definition json exactly as bungie shipped it
+func (store *ManifestStore) GetRaw(table string, hash Hash) (json.RawMessage, error) {
+	if !store.allowed(table) {
+		return nil, &ManifestError{Table: table, Err: ErrUnknownTable}
+	}
+	if entry, ok := store.cached(table, hash); ok {
+		return entry.raw, nil
+	}
+	return store.load(table, hash)
+}
 
-		m := Message{Type: "Error", Response: "Unable to query the destiny manifest"}
-		return m, Item{}
+// load reads a definition from the database and caches it
+func (store *ManifestStore) load(table string, hash Hash) (json.RawMessage, error) {
+	if err := store.acquire(); err != nil {
+		return nil, &ManifestError{Table: table, Hash: hash, Err: err}
 	}
+	defer store.mu.RUnlock()
 
-	var idd string
 	var jsondata string
-	for rows.Next() {
-		rows.Scan(&idd, &jsondata)
-		var data Item
-		json.Unmarshal([]byte(jsondata), &data)
+	err := store.stmts[table].QueryRow(hash.String()).Scan(&jsondata)
+	if err == sql.ErrNoRows {
+		return nil, &ManifestError{Table: table, Hash: hash, Err: ErrNotFound}
+	}
+	if err != nil {
+		return nil, &ManifestError{Table: table, Hash: hash, Err: err}
+	}
+	store.remember(table, hash, json.RawMessage(jsondata))
+	return json.RawMessage(jsondata), nil
+}
+
+func (store *ManifestStore) GetItem(hash Hash) (Item, error) {
+	raw, err := store.GetRaw(itemTable, hash)
+	if err != nil {
+		return Item{}, err
+	}
+	return store.decodeItem(hash, raw)
+}
+
+// decodeItem unmarshals an item definition, reusing the item the cache already decoded from the same json.
+// The item is shared with other requests and must not be modified.
+func (store *ManifestStore) decodeItem(hash Hash, raw json.RawMessage) (Item, error) {
+	key := cacheKey{Table: itemTable, Hash: hash, Lang: store.Lang}
+	if store.cache != nil {
+		if item, ok := store.cache.item(key, raw); ok {
+			return *item, nil
+		}
+	}
+
+	var item Item
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return Item{}, &ManifestError{Table: itemTable, Hash: hash, Err: err}
+	}
+	if store.cache != nil {
+		store.cache.decoded(key, raw, item)
+	}
+	return item, nil
+}
+
+// sqlite refuses statements with more than 999 parameters
+const manyChunkSize = 500
+
+// GetMany fetches every given hash of a table, hashes the manifest doesn't have are left out of the result
+func (store *ManifestStore) GetMany(table string, hashes []Hash) (map[Hash]json.RawMessage, error) {
+	if !store.allowed(table) {
+		return nil, &ManifestError{Table: table, Err: ErrUnknownTable}
+	}
 
-		return Message{}, data
+	found := make(map[Hash]json.RawMessage, len(hashes))
+	var missing []Hash
+	for _, hash := range hashes {
+		if entry, ok := store.cached(table, hash); ok {
+			found[hash] = entry.raw
+		} else {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	if err := store.acquire(); err != nil {
+		return nil, &ManifestError{Table: table, Err: err}
+	}
+	defer store.mu.RUnlock()
+
+	for start := 0; start < len(missing); start += manyChunkSize {
+		end := start + manyChunkSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		for _, hash := range missing[start:end] {
+			args = append(args, hash.String())
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+		rows, err := store.db.Query("SELECT hash, json FROM `"+table+"` WHERE hash IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, &ManifestError{Table: table, Err: err}
+		}
+		for rows.Next() {
+			var key, jsondata string
+			if err := rows.Scan(&key, &jsondata); err != nil {
+				rows.Close()
+				return nil, &ManifestError{Table: table, Err: err}
+			}
+			hash, _ := ParseHash(key)
+			found[hash] = json.RawMessage(jsondata)
+			store.remember(table, hash, found[hash])
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, &ManifestError{Table: table, Err: err}
+		}
+	}
+	return found, nil
+}
+
+// ManifestHTTPError turns a store error into the error a handler answers with
+func ManifestHTTPError(err error) *functions.Error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return &functions.Error{Status: http.StatusNotFound, Code: "not_found", Message: err.Error(), Err: err}
+	case errors.Is(err, ErrUnknownTable):
+		return &functions.Error{Status: http.StatusBadRequest, Code: "bad_request", Message: err.Error(), Err: err}
+	case errors.Is(err, os.ErrNotExist):
+		//the first download after a fresh deploy hasn't finished yet
+		return &functions.Error{Status: http.StatusServiceUnavailable, Code: "manifest_unavailable", Message: "The destiny manifest is not downloaded yet", Retryable: true, Err: err}
+	}
+	return functions.Internal("Unable to query the destiny manifest", err)
+}
+
+// ProjectFields keeps only the given dotted paths of a definition, e.g. displayProperties.name
+func ProjectFields(raw json.RawMessage, fields []string) (map[string]interface{}, error) {
+	projected := make(map[string]interface{})
+	if raw == nil {
+		return projected, nil
+	}
+
+	var full map[string]interface{}
+	if err := json.Unmarshal(raw, &full); err != nil {
+		return nil, err
 	}
-	return Message{}, Item{}
 
+	for _, field := range fields {
+		path := strings.Split(strings.TrimSpace(field), ".")
+		var value interface{} = full
+		for _, key := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value, ok = object[key]
+			if !ok {
+				break
+			}
+		}
+		if value == nil {
+			continue
+		}
+
+		//rebuilding the nesting down to the value
+		target := projected
+		for _, key := range path[:len(path)-1] {
+			next, ok := target[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				target[key] = next
+			}
+			target = next
+		}
+		target[path[len(path)-1]] = value
+	}
+	return projected, nil
+}
+
+// ParseFields reads the comma separated fields query parameter
+func ParseFields(router *http.Request) []string {
+	var fields []string
+	for _, field := range strings.Split(router.URL.Query().Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
 }
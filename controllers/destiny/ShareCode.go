@@ -0,0 +1,294 @@
+package destiny
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"projector/controllers/functions"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// ShareVersion is the version new share codes are written with. Codes of older versions keep decoding,
+// so a version and its name tables must never change once released, add a new version instead.
+const ShareVersion = 1
+
+// the names of version 1 are written as their index, anything else as 0xff followed by the name
+var shareSlotsV1 = []string{"kinetic", "energy", "heavy", "helmet", "gauntlets", "chest_armor", "leg_armor", "class_armor"}
+var shareListsV1 = []string{"aspects", "fragments", "recomended_perks", "recomended_mods", "optional_mods"}
+
+const shareCustomName = 0xff
+
+// ErrShareCode is wrapped by every code that can't be decoded
+var ErrShareCode = errors.New("invalid share code")
+
+// shareClasses is the class byte of a code, the manifest classType of the class
+var shareClasses = map[int]string{0: "titan", 1: "hunter", 2: "warlock"}
+
+type shareWriter struct {
+	bytes.Buffer
+}
+
+func (writer *shareWriter) uvarint(value int) {
+	var buf [binary.MaxVarintLen64]byte
+	writer.Write(buf[:binary.PutUvarint(buf[:], uint64(value))])
+}
+
+func (writer *shareWriter) text(value string) {
+	writer.uvarint(len(value))
+	writer.WriteString(value)
+}
+
+func (writer *shareWriter) name(names []string, value string) {
+	for i, name := range names {
+		if name == value {
+			writer.WriteByte(byte(i))
+			return
+		}
+	}
+	writer.WriteByte(shareCustomName)
+	writer.text(value)
+}
+
+func (writer *shareWriter) hash(id string) error {
+	var hash Hash
+	if id != "" {
+		parsed, err := ParseHash(id)
+		if err != nil {
+			return err
+		}
+		hash = parsed
+	}
+	return binary.Write(writer, binary.BigEndian, uint32(hash))
+}
+
+func (writer *shareWriter) slot(slot Slot) error {
+	if err := writer.hash(slot.Item); err != nil {
+		return err
+	}
+
+	lists := make([]string, 0, len(slot.Lists))
+	for name := range slot.Lists {
+		lists = append(lists, name)
+	}
+	sort.Strings(lists)
+
+	writer.uvarint(len(lists))
+	for _, name := range lists {
+		writer.name(shareListsV1, name)
+		writer.uvarint(len(slot.Lists[name]))
+		for _, id := range slot.Lists[name] {
+			if err := writer.hash(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EncodeShareCode packs a build into a url safe code
+func EncodeShareCode(class string, build Class) (string, error) {
+	classType, ok := ClassTypes[class]
+	if !ok {
+		return "", fmt.Errorf("unknown class %q", class)
+	}
+
+	var writer shareWriter
+	writer.WriteByte(ShareVersion)
+	writer.WriteByte(byte(classType))
+	writer.text(build.Name)
+	writer.uvarint(len(build.Preference))
+	for _, preference := range build.Preference {
+		writer.text(preference)
+	}
+
+	if err := writer.slot(build.Subclass); err != nil {
+		return "", err
+	}
+
+	slots := make([]string, 0, len(build.Slots))
+	for name := range build.Slots {
+		slots = append(slots, name)
+	}
+	sort.Strings(slots)
+
+	writer.uvarint(len(slots))
+	for _, name := range slots {
+		writer.name(shareSlotsV1, name)
+		if err := writer.slot(build.Slots[name]); err != nil {
+			return "", err
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(writer.Bytes()), nil
+}
+
+// shareReader keeps the first error so decoding reads straight through and checks once at the end
+type shareReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (reader *shareReader) byte() byte {
+	if reader.err != nil {
+		return 0
+	}
+	value, err := reader.ReadByte()
+	reader.err = err
+	return value
+}
+
+// count reads a length, refusing ones longer than what is left of the code
+func (reader *shareReader) count() int {
+	if reader.err != nil {
+		return 0
+	}
+	value, err := binary.ReadUvarint(reader)
+	if err == nil && value > uint64(reader.Len()) {
+		err = io.ErrUnexpectedEOF
+	}
+	reader.err = err
+	return int(value)
+}
+
+func (reader *shareReader) text() string {
+	value := make([]byte, reader.count())
+	if reader.err == nil {
+		_, reader.err = io.ReadFull(reader, value)
+	}
+	return string(value)
+}
+
+func (reader *shareReader) name(names []string) string {
+	index := reader.byte()
+	if index == shareCustomName {
+		return reader.text()
+	}
+	if int(index) >= len(names) {
+		if reader.err == nil {
+			reader.err = fmt.Errorf("unknown name %d", index)
+		}
+		return ""
+	}
+	return names[index]
+}
+
+func (reader *shareReader) hash() string {
+	var hash uint32
+	if reader.err == nil {
+		reader.err = binary.Read(reader, binary.BigEndian, &hash)
+	}
+	if hash == 0 {
+		return ""
+	}
+	return Hash(hash).String()
+}
+
+func (reader *shareReader) slot() Slot {
+	slot := Slot{Item: reader.hash(), Lists: make(map[string][]string)}
+	lists := reader.count()
+	for i := 0; i < lists && reader.err == nil; i++ {
+		name := reader.name(shareListsV1)
+		list := make([]string, 0, reader.count())
+		for j := 0; j < cap(list) && reader.err == nil; j++ {
+			list = append(list, reader.hash())
+		}
+		slot.Lists[name] = list
+	}
+	return slot
+}
+
+// DecodeShareCode unpacks a code of any released version into the class and build it was made from
+func DecodeShareCode(code string) (string, Class, error) {
+	data, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil || len(data) == 0 {
+		return "", Class{}, fmt.Errorf("%w: not base64url", ErrShareCode)
+	}
+
+	reader := &shareReader{Reader: bytes.NewReader(data[1:])}
+	var class string
+	var build Class
+	switch data[0] {
+	case 1:
+		class, build = decodeShareV1(reader)
+	default:
+		return "", Class{}, fmt.Errorf("%w: unsupported version %d", ErrShareCode, data[0])
+	}
+
+	if reader.err == nil && reader.Len() > 0 {
+		reader.err = errors.New("trailing data")
+	}
+	if reader.err != nil {
+		return "", Class{}, fmt.Errorf("%w: %v", ErrShareCode, reader.err)
+	}
+	return class, build, nil
+}
+
+func decodeShareV1(reader *shareReader) (string, Class) {
+	class, ok := shareClasses[int(reader.byte())]
+	if !ok && reader.err == nil {
+		reader.err = errors.New("unknown class")
+	}
+
+	build := Class{Name: reader.text(), Slots: make(map[string]Slot)}
+	preferences := reader.count()
+	for i := 0; i < preferences && reader.err == nil; i++ {
+		build.Preference = append(build.Preference, reader.text())
+	}
+
+	build.Subclass = reader.slot()
+	slots := reader.count()
+	for i := 0; i < slots && reader.err == nil; i++ {
+		name := reader.name(shareSlotsV1)
+		build.Slots[name] = reader.slot()
+	}
+	return class, build
+}
+
+// GetSharedBuild resolves the build packed in a share code like GetBuilds does
+func GetSharedBuild(w http.ResponseWriter, router *http.Request) {
+	class, build, err := DecodeShareCode(mux.Vars(router)["code"])
+	if err != nil {
+		functions.WriteError(w, functions.BadRequest(err.Error()))
+		return
+	}
+
+	items, err := newItemResolver(Manifest.Store(Language(router)), build.Hashes(), ParseFields(router))
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	buildData, err := items.resolveBuild(build)
+	if err != nil {
+		functions.WriteError(w, err)
+		return
+	}
+	buildData["class"] = class
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildData)
+}
+
+// GetBuildShareCode answers with the share code of a stored build
+func GetBuildShareCode(w http.ResponseWriter, router *http.Request) {
+	vars := mux.Vars(router)
+	stored, err := Builds.Get(vars["class"], vars["id"])
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+
+	code, err := EncodeShareCode(stored.Class, stored.Build)
+	if err != nil {
+		functions.WriteError(w, functions.Internal("Unable to make the share code", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"code": code})
+}
@@ -0,0 +1,58 @@
+package destiny
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// shareCodeV1 was written by version 1 and has to decode to the same build for as long as
+// version 1 is released, a change to its name tables or byte layout breaks it
+const shareCodeV1 = "AQIEVm9pZAIKRGlzY2lwbGluZQhSZWNvdmVyecPJYlcCAAIAAADIAAAAyQEBAAABLAP_CGFydGlmYWN0AAAAAAH_BG1vZHMB_____wMAAAGaAgQAAwEAAAGkAAAAAZABAgIAAAHEAAAByQ"
+
+func TestDecodeShareCodeV1(t *testing.T) {
+	class, build, err := DecodeShareCode(shareCodeV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class != "warlock" {
+		t.Errorf("expected a warlock build, got %s", class)
+	}
+	sameBuild(t, build, fixtureBuild(t, `{"name":"Void","preference":["Discipline","Recovery"],
+		"subclass":{"item":"3284755031","aspects":["200","201"],"fragments":["300"]},
+		"kinetic":{"item":"400","recomended_perks":["452","457"]},
+		"helmet":{"item":"410","recomended_mods":["420"],"optional_mods":[]},
+		"artifact":{"item":"","mods":["4294967295"]}}`))
+
+	//the same build encodes to the same code, slots and lists go in sorted
+	if code, err := EncodeShareCode(class, build); err != nil || code != shareCodeV1 {
+		t.Errorf("expected the build to encode to the released code, got %s %v", code, err)
+	}
+}
+
+func TestDecodeShareCodeMalformed(t *testing.T) {
+	released, _ := base64.RawURLEncoding.DecodeString(shareCodeV1)
+
+	tests := []struct {
+		name string
+		code string
+	}{
+		{name: "not base64url", code: "AQ+/"},
+		{name: "empty", code: ""},
+		{name: "unknown version", code: base64.RawURLEncoding.EncodeToString(append([]byte{2}, released[1:]...))},
+		{name: "unknown class", code: base64.RawURLEncoding.EncodeToString([]byte{1, 7, 0, 0, 0, 0, 0, 0, 0, 0})},
+		{name: "truncated", code: base64.RawURLEncoding.EncodeToString(released[:len(released)-3])},
+		{name: "count past the end", code: base64.RawURLEncoding.EncodeToString([]byte{1, 2, 16, 'V', 'o', 'i', 'd'})},
+		{name: "huge count", code: base64.RawURLEncoding.EncodeToString([]byte{1, 2, 0, 0xff, 0xff, 0xff, 0xff, 0x0f})},
+		{name: "unknown slot name", code: base64.RawURLEncoding.EncodeToString([]byte{1, 2, 0, 0, 0, 0, 0, 0, 0, 1, 9})},
+		{name: "trailing data", code: base64.RawURLEncoding.EncodeToString(append(append([]byte{}, released...), 0))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := DecodeShareCode(test.code); !errors.Is(err, ErrShareCode) {
+				t.Errorf("expected ErrShareCode, got %v", err)
+			}
+		})
+	}
+}
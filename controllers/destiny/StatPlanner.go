@@ -0,0 +1,573 @@
+package destiny
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// StatOrder is the order the game lists armor stats in
+var StatOrder = []string{"Mobility", "Resilience", "Recovery", "Discipline", "Intellect", "Strength"}
+
+// ArmorSlots are the slots a plan picks one piece for
+var ArmorSlots = []string{"helmet", "gauntlets", "chest_armor", "leg_armor", "class_armor"}
+
+const (
+	exoticTier = 6
+	statCap    = 100
+	majorMod   = 10
+	minorMod   = 5
+)
+
+// MaxArmorPerSlot bounds the pieces posted for one slot, a full vault holds about fifty
+const MaxArmorPerSlot = 60
+
+// ErrNoArmor is returned when a slot has no piece to pick from
+var ErrNoArmor = errors.New("no armor for the slot")
+
+// ErrTooMuchArmor is returned when a slot has more than MaxArmorPerSlot pieces
+var ErrTooMuchArmor = fmt.Errorf("more than %d pieces for the slot", MaxArmorPerSlot)
+
+// ArmorPiece is one piece a character owns, Stats are its base stats by name
+type ArmorPiece struct {
+	Hash       Hash           `json:"hash"`
+	InstanceID string         `json:"instanceId,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Slot       string         `json:"slot"`
+	Exotic     bool           `json:"exotic"`
+	Stats      map[string]int `json:"stats"`
+}
+
+type StatMod struct {
+	Stat  string `json:"stat"`
+	Size  string `json:"size"`
+	Value int    `json:"value"`
+}
+
+type PlanStat struct {
+	Name  string `json:"name"`
+	Base  int    `json:"base"`
+	Mods  int    `json:"mods"`
+	Total int    `json:"total"`
+	Tier  int    `json:"tier"`
+}
+
+// Plan is the best set of armor found, Tiers adds up the tiers of every stat
+type Plan struct {
+	Pieces       map[string]ArmorPiece `json:"pieces"`
+	Mods         []StatMod             `json:"mods"`
+	Stats        []PlanStat            `json:"stats"`
+	Tiers        int                   `json:"tiers"`
+	Combinations int                   `json:"combinations"`
+}
+
+// PlanOptions limits what a plan may use, Mods is how many stat mods fit, one per piece by default
+type PlanOptions struct {
+	Mods int `json:"mods"`
+}
+
+// statLine holds a value for every stat, in StatOrder
+type statLine [6]int
+
+func lineOf(stats map[string]int) statLine {
+	var line statLine
+	for i, stat := range StatOrder {
+		line[i] = stats[stat]
+	}
+	return line
+}
+
+// candidate is a piece with its stats laid out for the search
+type candidate struct {
+	piece ArmorPiece
+	stats statLine
+	total int
+}
+
+// PlanArmor picks one piece per armor slot, at most one of them exotic, and the stat mods that
+// raise the preferred stats the most tiers, the first preference before the second and so on.
+// Ties are broken by the tiers of all stats together, then by the most points under the cap.
+// Pieces another piece of the slot beats are left out, and combinations that can't beat the best one
+// found so far, even with the best of every slot left, are skipped. Both keep the result exact.
+// Combinations counts the ones that were scored.
+func PlanArmor(pieces []ArmorPiece, preference []string, options PlanOptions) (Plan, error) {
+	preferred := make([]int, 0, len(preference))
+	for _, name := range preference {
+		stat, ok := statName(name)
+		if !ok {
+			return Plan{}, fmt.Errorf("unknown stat %q", name)
+		}
+		preferred = append(preferred, statIndex(stat))
+	}
+
+	bySlot := make(map[string][]ArmorPiece)
+	for _, piece := range pieces {
+		bySlot[piece.Slot] = append(bySlot[piece.Slot], piece)
+	}
+	candidates := make([][]candidate, len(ArmorSlots))
+	for i, slot := range ArmorSlots {
+		if len(bySlot[slot]) == 0 {
+			return Plan{}, fmt.Errorf("%s: %w", slot, ErrNoArmor)
+		}
+		if len(bySlot[slot]) > MaxArmorPerSlot {
+			return Plan{}, fmt.Errorf("%s: %w", slot, ErrTooMuchArmor)
+		}
+		for _, piece := range dominant(bySlot[slot]) {
+			line := lineOf(piece.Stats)
+			total := 0
+			for _, value := range line {
+				total += value
+			}
+			candidates[i] = append(candidates[i], candidate{piece: piece, stats: line, total: total})
+		}
+		//strong pieces first, the sooner a good plan is found the more the bound below skips
+		sort.SliceStable(candidates[i], func(a, b int) bool {
+			return strongerPiece(candidates[i][a], candidates[i][b], preferred)
+		})
+	}
+
+	//left[i] is the most every stat, and all of them together, can still gain from slot i on
+	left := make([]statLine, len(ArmorSlots)+1)
+	leftTotal := make([]int, len(ArmorSlots)+1)
+	for i := len(ArmorSlots) - 1; i >= 0; i-- {
+		left[i], leftTotal[i] = left[i+1], leftTotal[i+1]
+		most := 0
+		for stat := range left[i] {
+			highest := 0
+			for _, piece := range candidates[i] {
+				if piece.stats[stat] > highest {
+					highest = piece.stats[stat]
+				}
+			}
+			left[i][stat] += highest
+		}
+		for _, piece := range candidates[i] {
+			if piece.total > most {
+				most = piece.total
+			}
+		}
+		leftTotal[i] += most
+	}
+
+	combinations := 0
+	var bestScore []int
+	best := make([]ArmorPiece, len(ArmorSlots))
+	chosen := make([]ArmorPiece, len(ArmorSlots))
+	score, upper := make([]int, 0, len(preferred)+2), make([]int, 0, len(preferred)+2)
+	var totals statLine
+	var walk func(slot int, exotic bool)
+	walk = func(slot int, exotic bool) {
+		if slot == len(ArmorSlots) {
+			combinations++
+			score = lineScore(spendMods(totals, preferred, options.Mods, nil), preferred, score)
+			if bestScore == nil || betterScore(score, bestScore) {
+				bestScore = append(bestScore[:0], score...)
+				copy(best, chosen)
+			}
+			return
+		}
+		if bestScore != nil {
+			upper = upperScore(totals, left[slot], leftTotal[slot], preferred, options.Mods, upper)
+			if !betterScore(upper, bestScore) {
+				return
+			}
+		}
+		for _, piece := range candidates[slot] {
+			if piece.piece.Exotic && exotic {
+				continue
+			}
+			chosen[slot] = piece.piece
+			for stat, value := range piece.stats {
+				totals[stat] += value
+			}
+			walk(slot+1, exotic || piece.piece.Exotic)
+			for stat, value := range piece.stats {
+				totals[stat] -= value
+			}
+		}
+	}
+	walk(0, false)
+
+	if bestScore == nil {
+		return Plan{}, errors.New("every combination has more than one exotic")
+	}
+	plan := statPlan(best, preference, options.Mods)
+	plan.Combinations = combinations
+	return plan, nil
+}
+
+// dominant drops the pieces another piece of the slot beats or matches in every stat,
+// an exotic is only dropped for another exotic since it blocks the other slots
+func dominant(pieces []ArmorPiece) []ArmorPiece {
+	kept := make([]ArmorPiece, 0, len(pieces))
+	for i, piece := range pieces {
+		beaten := false
+		for j, other := range pieces {
+			if i == j || (other.Exotic && !piece.Exotic) {
+				continue
+			}
+			if covers(other, piece) && (!covers(piece, other) || j < i) {
+				beaten = true
+				break
+			}
+		}
+		if !beaten {
+			kept = append(kept, piece)
+		}
+	}
+	return kept
+}
+
+// strongerPiece orders pieces by their preferred stats together, then by all their stats
+func strongerPiece(a, b candidate, preferred []int) bool {
+	sumA, sumB := 0, 0
+	for _, stat := range preferred {
+		sumA += a.stats[stat]
+		sumB += b.stats[stat]
+	}
+	if sumA != sumB {
+		return sumA > sumB
+	}
+	return a.total > b.total
+}
+
+func covers(a, b ArmorPiece) bool {
+	for _, stat := range StatOrder {
+		if a.Stats[stat] < b.Stats[stat] {
+			return false
+		}
+	}
+	return true
+}
+
+func statIndex(name string) int {
+	for i, stat := range StatOrder {
+		if stat == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// spendMods spends the mods on the preferred stats in order and what's left on the others in game order,
+// a tier a minor mod reaches gets a minor mod. Every mod raises its stat exactly one tier.
+func spendMods(totals statLine, preferred []int, mods int, spent *[]StatMod) statLine {
+	spend := func(stat int) {
+		for mods > 0 && totals[stat] < statCap {
+			mod := StatMod{Stat: StatOrder[stat], Size: "major", Value: majorMod}
+			if totals[stat]%10 >= minorMod {
+				mod = StatMod{Stat: StatOrder[stat], Size: "minor", Value: minorMod}
+			}
+			totals[stat] += mod.Value
+			if spent != nil {
+				*spent = append(*spent, mod)
+			}
+			mods--
+		}
+	}
+	for _, stat := range preferred {
+		spend(stat)
+	}
+	for stat := range totals {
+		spend(stat)
+	}
+	return totals
+}
+
+// statPlan adds up the stats of the pieces and spends the mods on them, see spendMods
+func statPlan(pieces []ArmorPiece, preference []string, mods int) Plan {
+	plan := Plan{Pieces: make(map[string]ArmorPiece, len(pieces)), Mods: []StatMod{}}
+	var base statLine
+	for i, piece := range pieces {
+		plan.Pieces[ArmorSlots[i]] = piece
+		line := lineOf(piece.Stats)
+		for stat := range base {
+			base[stat] += line[stat]
+		}
+	}
+	preferred := make([]int, 0, len(preference))
+	for _, name := range preference {
+		if stat, ok := statName(name); ok {
+			preferred = append(preferred, statIndex(stat))
+		}
+	}
+
+	totals := spendMods(base, preferred, mods, &plan.Mods)
+	for i, stat := range StatOrder {
+		planStat := PlanStat{Name: stat, Base: base[i], Mods: totals[i] - base[i], Total: totals[i], Tier: tier(totals[i])}
+		plan.Stats = append(plan.Stats, planStat)
+		plan.Tiers += planStat.Tier
+	}
+	return plan
+}
+
+func tier(value int) int {
+	if value > statCap {
+		value = statCap
+	}
+	return value / 10
+}
+
+// lineScore is what plans are compared by: the tier of every preferred stat in order, then the
+// tiers of all stats, then the points under the cap the next fragment or mod could build on.
+// It is written into score to spare the search an allocation per combination.
+func lineScore(totals statLine, preferred []int, score []int) []int {
+	score = score[:0]
+	for _, stat := range preferred {
+		score = append(score, tier(totals[stat]))
+	}
+	tiers, points := 0, 0
+	for _, value := range totals {
+		tiers += tier(value)
+		if value > statCap {
+			value = statCap
+		}
+		points += value
+	}
+	return append(score, tiers, points)
+}
+
+// planScore scores a finished plan the way the search did
+func planScore(plan Plan, preference []string) []int {
+	var totals statLine
+	for _, stat := range plan.Stats {
+		totals[statIndex(stat.Name)] = stat.Total
+	}
+	preferred := make([]int, 0, len(preference))
+	for _, name := range preference {
+		if stat, ok := statName(name); ok {
+			preferred = append(preferred, statIndex(stat))
+		}
+	}
+	return lineScore(totals, preferred, nil)
+}
+
+// upperScore is a score no combination starting with the given totals can beat. Each stat may get the
+// best piece of every slot left, but all of them together no more points than the best totals of the
+// slots left. Each mod raises a stat one tier, a major mod's worth of points. A preferred stat only
+// counts on the mods the stats before it leave, a combination that doesn't reach their bound loses anyway.
+func upperScore(totals, left statLine, leftTotal int, preferred []int, mods int, score []int) []int {
+	score = score[:0]
+	spare := mods
+	var reached statLine
+	var seen [len(statLine{})]bool
+	for _, stat := range preferred {
+		if !seen[stat] {
+			seen[stat] = true
+			armor := tier(totals[stat] + left[stat])
+			reached[stat] = armor + spare
+			if reached[stat] > statCap/10 {
+				reached[stat] = statCap / 10
+			}
+			if reached[stat] > armor {
+				spare -= reached[stat] - armor
+			}
+		}
+		score = append(score, reached[stat])
+	}
+
+	tiers := armorTiers(totals, left, leftTotal) + mods
+	if tiers > len(totals)*statCap/10 {
+		tiers = len(totals) * statCap / 10
+	}
+	points, sum := mods*majorMod, leftTotal+mods*majorMod
+	for stat, value := range totals {
+		capped := value + left[stat]
+		if capped > statCap {
+			capped = statCap
+		}
+		points += capped
+		sum += value
+	}
+	if points > sum {
+		points = sum
+	}
+	return append(score, tiers, points)
+}
+
+// armorTiers is the most tiers the armor alone can reach when budget points are spread over the stats,
+// no stat getting more than left of them. The first tier a stat gains may cost less than ten points and
+// every later one costs ten, so buying the cheap first tiers before anything else is the best spread.
+func armorTiers(totals, left statLine, budget int) int {
+	var first statLine
+	tiers, firsts, later := 0, 0, 0
+	for stat, value := range totals {
+		tiers += tier(value)
+		gains := tier(value+left[stat]) - tier(value)
+		if gains > 0 {
+			first[firsts] = 10 - value%10
+			firsts++
+		}
+		if gains > 1 {
+			later += gains - 1
+		}
+	}
+	cheap := first[:firsts]
+	sort.Ints(cheap)
+	for _, cost := range cheap {
+		if cost > budget {
+			//later tiers cost ten, no less than any first tier, so none of them fit either
+			return tiers
+		}
+		budget -= cost
+		tiers++
+	}
+	if extra := budget / 10; extra < later {
+		return tiers + extra
+	}
+	return tiers + later
+}
+
+func betterScore(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// statName finds the stat a name or a stat hash stands for
+func statName(key string) (string, bool) {
+	for name, hash := range StatHashes {
+		if strings.EqualFold(name, key) || hash.String() == key {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+type planRequest struct {
+	Armor []struct {
+		Hash       Hash           `json:"hash"`
+		InstanceID string         `json:"instanceId"`
+		Stats      map[string]int `json:"stats"`
+	} `json:"armor"`
+	Mods *int `json:"mods"`
+}
+
+// armorPieces fills in the slot, name and exotic tier of every piece from the manifest,
+// pieces another class wears are refused
+func armorPieces(store *ManifestStore, class string, request planRequest) ([]ArmorPiece, error) {
+	hashes := make([]Hash, 0, len(request.Armor))
+	for _, armor := range request.Armor {
+		hashes = append(hashes, armor.Hash)
+	}
+	items, err := store.GetMany(itemTable, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make(map[Hash]string, len(ArmorSlots))
+	for _, slot := range ArmorSlots {
+		slots[SlotEquipment[slot]] = slot
+	}
+
+	pieces := make([]ArmorPiece, 0, len(request.Armor))
+	for _, armor := range request.Armor {
+		data, ok := items[armor.Hash]
+		if !ok {
+			return nil, functions.BadRequest(fmt.Sprintf("Item %s is not in the destiny manifest", armor.Hash))
+		}
+		var definition struct {
+			DisplayProperties struct {
+				Name string `json:"name"`
+			} `json:"displayProperties"`
+			ClassType int `json:"classType"`
+			Inventory struct {
+				BucketTypeHash Hash `json:"bucketTypeHash"`
+				TierType       int  `json:"tierType"`
+			} `json:"inventory"`
+		}
+		if err := json.Unmarshal(data, &definition); err != nil {
+			return nil, functions.Internal("Unable to read the destiny manifest", err)
+		}
+
+		slot, ok := slots[definition.Inventory.BucketTypeHash]
+		if !ok {
+			return nil, functions.BadRequest(fmt.Sprintf("Item %s is not armor", armor.Hash))
+		}
+		if definition.ClassType != ClassTypes[class] && definition.ClassType != 3 {
+			return nil, functions.BadRequest(fmt.Sprintf("%s is not %s armor", definition.DisplayProperties.Name, class))
+		}
+
+		piece := ArmorPiece{
+			Hash:       armor.Hash,
+			InstanceID: armor.InstanceID,
+			Name:       definition.DisplayProperties.Name,
+			Slot:       slot,
+			Exotic:     definition.Inventory.TierType == exoticTier,
+			Stats:      make(map[string]int, len(armor.Stats)),
+		}
+		for key, value := range armor.Stats {
+			stat, ok := statName(key)
+			if !ok {
+				return nil, functions.BadRequest(fmt.Sprintf("Unknown stat %q on %s", key, piece.Name))
+			}
+			if _, ok := piece.Stats[stat]; ok {
+				return nil, functions.BadRequest(fmt.Sprintf("%s is given twice on %s", stat, piece.Name))
+			}
+			piece.Stats[stat] = value
+		}
+		pieces = append(pieces, piece)
+	}
+	return pieces, nil
+}
+
+// PostBuildPlan plans the armor of a build from the pieces posted, see PlanArmor
+func PostBuildPlan(w http.ResponseWriter, router *http.Request) {
+	stored, err := Builds.Find(mux.Vars(router)["id"])
+	if err != nil {
+		functions.WriteError(w, BuildHTTPError(err))
+		return
+	}
+
+	var request planRequest
+	if err := json.NewDecoder(router.Body).Decode(&request); err != nil {
+		functions.WriteError(w, functions.BadRequest("Unable to read the armor: "+err.Error()))
+		return
+	}
+	//more than every slot can take is refused before any manifest lookup
+	if len(request.Armor) > MaxArmorPerSlot*len(ArmorSlots) {
+		functions.WriteError(w, functions.BadRequest(fmt.Sprintf("At most %d pieces of armor a slot can be planned", MaxArmorPerSlot)))
+		return
+	}
+	options := PlanOptions{Mods: len(ArmorSlots)}
+	if request.Mods != nil {
+		if *request.Mods < 0 || *request.Mods > len(ArmorSlots) {
+			functions.WriteError(w, functions.BadRequest(fmt.Sprintf("mods has to be from 0 to %d", len(ArmorSlots))))
+			return
+		}
+		options.Mods = *request.Mods
+	}
+
+	pieces, err := armorPieces(Manifest.Store(Language(router)), stored.Class, request)
+	var httpErr *functions.Error
+	if errors.As(err, &httpErr) {
+		functions.WriteError(w, err)
+		return
+	}
+	if err != nil {
+		functions.WriteError(w, ManifestHTTPError(err))
+		return
+	}
+
+	plan, err := PlanArmor(pieces, stored.Build.Preference, options)
+	if err != nil {
+		functions.WriteError(w, functions.BadRequest("Unable to plan the armor: "+err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"build":      diffSide{ID: stored.ID, Class: stored.Class, Name: stored.Build.Name},
+		"preference": stored.Build.Preference,
+		"plan":       plan,
+	})
+}
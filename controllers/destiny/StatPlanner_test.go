@@ -0,0 +1,325 @@
+package destiny
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// piece makes an armor piece with its stats in game order
+func piece(slot string, hash Hash, exotic bool, stats ...int) ArmorPiece {
+	armor := ArmorPiece{Hash: hash, Slot: slot, Exotic: exotic, Stats: make(map[string]int, len(StatOrder))}
+	for i, value := range stats {
+		armor.Stats[StatOrder[i]] = value
+	}
+	return armor
+}
+
+// flatArmor is one plain legendary per slot with ten in every stat
+func flatArmor() []ArmorPiece {
+	pieces := make([]ArmorPiece, 0, len(ArmorSlots))
+	for i, slot := range ArmorSlots {
+		pieces = append(pieces, piece(slot, Hash(100+i), false, 10, 10, 10, 10, 10, 10))
+	}
+	return pieces
+}
+
+// withPieces replaces the flat pieces of the slots the given pieces go in
+func withPieces(extra ...ArmorPiece) []ArmorPiece {
+	replaced := make(map[string]bool)
+	for _, armor := range extra {
+		replaced[armor.Slot] = true
+	}
+	pieces := append([]ArmorPiece{}, extra...)
+	for _, armor := range flatArmor() {
+		if !replaced[armor.Slot] {
+			pieces = append(pieces, armor)
+		}
+	}
+	return pieces
+}
+
+func TestPlanArmor(t *testing.T) {
+	tests := []struct {
+		name       string
+		pieces     []ArmorPiece
+		preference []string
+		mods       int
+		picked     map[string]Hash
+		stats      map[string]int
+		modSizes   []string
+		err        error
+	}{
+		{
+			name: "one exotic at most",
+			pieces: withPieces(
+				piece("helmet", 1, true, 2, 2, 30, 2, 2, 2),
+				piece("gauntlets", 2, true, 2, 2, 30, 2, 2, 2),
+				piece("gauntlets", 3, false, 2, 2, 20, 2, 2, 2),
+			),
+			preference: []string{"Recovery"},
+			picked:     map[string]Hash{"helmet": 1, "gauntlets": 3},
+			stats:      map[string]int{"Recovery": 80},
+		},
+		{
+			name: "first preference before the second",
+			pieces: withPieces(
+				piece("helmet", 1, false, 2, 2, 2, 30, 2, 2),
+				piece("helmet", 2, false, 2, 2, 2, 2, 30, 2),
+			),
+			preference: []string{"Intellect", "Discipline"},
+			picked:     map[string]Hash{"helmet": 2},
+			stats:      map[string]int{"Intellect": 70, "Discipline": 42},
+		},
+		{
+			name: "preference by stat hash",
+			pieces: withPieces(
+				piece("helmet", 1, false, 2, 2, 2, 30, 2, 2),
+				piece("helmet", 2, false, 2, 2, 2, 2, 30, 2),
+			),
+			preference: []string{"1735777505"},
+			picked:     map[string]Hash{"helmet": 1},
+			stats:      map[string]int{"Discipline": 70},
+		},
+		{
+			name: "a minor mod when it reaches the tier",
+			pieces: withPieces(
+				piece("helmet", 1, false, 10, 10, 15, 10, 10, 10),
+			),
+			preference: []string{"Recovery"},
+			mods:       1,
+			stats:      map[string]int{"Recovery": 60},
+			modSizes:   []string{"minor"},
+		},
+		{
+			name: "a major mod otherwise",
+			pieces: withPieces(
+				piece("helmet", 1, false, 10, 10, 12, 10, 10, 10),
+			),
+			preference: []string{"Recovery"},
+			mods:       1,
+			stats:      map[string]int{"Recovery": 62},
+			modSizes:   []string{"major"},
+		},
+		{
+			name: "mods move on at the cap",
+			pieces: withPieces(
+				piece("helmet", 1, false, 10, 10, 50, 10, 10, 10),
+			),
+			preference: []string{"Recovery", "Mobility"},
+			mods:       2,
+			stats:      map[string]int{"Recovery": 100, "Mobility": 60},
+			modSizes:   []string{"major", "major"},
+		},
+		{
+			name:       "no armor for a slot",
+			pieces:     flatArmor()[1:],
+			preference: []string{"Recovery"},
+			err:        ErrNoArmor,
+		},
+		{
+			name:       "too much armor for a slot",
+			pieces:     append(flatArmor(), randomArmor(rand.New(rand.NewSource(1)), MaxArmorPerSlot)...),
+			preference: []string{"Recovery"},
+			err:        ErrTooMuchArmor,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := PlanArmor(test.pieces, test.preference, PlanOptions{Mods: test.mods})
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for slot, hash := range test.picked {
+				if plan.Pieces[slot].Hash != hash {
+					t.Errorf("expected %s in the %s slot, got %s", hash, slot, plan.Pieces[slot].Hash)
+				}
+			}
+			for _, stat := range plan.Stats {
+				if want, ok := test.stats[stat.Name]; ok && stat.Total != want {
+					t.Errorf("expected %s %d, got %d", stat.Name, want, stat.Total)
+				}
+			}
+			if test.modSizes != nil {
+				if len(plan.Mods) != len(test.modSizes) {
+					t.Fatalf("expected mods %v, got %+v", test.modSizes, plan.Mods)
+				}
+				for i, size := range test.modSizes {
+					if plan.Mods[i].Size != size {
+						t.Errorf("expected a %s mod, got %+v", size, plan.Mods[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+// randomArmor rolls pieces for every slot the way armor 2.0 drops, mobility, resilience and recovery
+// share up to 34 points and so do the other three, no stat under 2 or over 30
+func randomArmor(random *rand.Rand, perSlot int) []ArmorPiece {
+	group := func() []int {
+		stats := []int{2, 2, 2}
+		for points := 10 + random.Intn(23); points > 0; points-- {
+			if stat := random.Intn(3); stats[stat] < 30 {
+				stats[stat]++
+			}
+		}
+		return stats
+	}
+	var pieces []ArmorPiece
+	for i, slot := range ArmorSlots {
+		for j := 0; j < perSlot; j++ {
+			pieces = append(pieces, piece(slot, Hash(1000*(i+1)+j), j%10 == 0, append(group(), group()...)...))
+		}
+	}
+	return pieces
+}
+
+// exhaustive finds the best score by trying every combination, what the bound must agree with
+func exhaustive(pieces []ArmorPiece, preference []string, mods int) []int {
+	bySlot := make(map[string][]ArmorPiece)
+	for _, armor := range pieces {
+		bySlot[armor.Slot] = append(bySlot[armor.Slot], armor)
+	}
+	var preferred []int
+	for _, name := range preference {
+		stat, _ := statName(name)
+		preferred = append(preferred, statIndex(stat))
+	}
+
+	var best []int
+	var totals statLine
+	var walk func(slot int, exotic bool)
+	walk = func(slot int, exotic bool) {
+		if slot == len(ArmorSlots) {
+			if score := lineScore(spendMods(totals, preferred, mods, nil), preferred, nil); best == nil || betterScore(score, best) {
+				best = score
+			}
+			return
+		}
+		for _, armor := range bySlot[ArmorSlots[slot]] {
+			if armor.Exotic && exotic {
+				continue
+			}
+			line := lineOf(armor.Stats)
+			for stat := range totals {
+				totals[stat] += line[stat]
+			}
+			walk(slot+1, exotic || armor.Exotic)
+			for stat := range totals {
+				totals[stat] -= line[stat]
+			}
+		}
+	}
+	walk(0, false)
+	return best
+}
+
+// balancedHelmets are ten helmets with 20 Discipline and 20 Recovery that don't beat each other,
+// next to one with 30 Discipline that is weak at everything else
+func balancedHelmets() []ArmorPiece {
+	pieces := []ArmorPiece{piece("helmet", 1, false, 2, 2, 2, 30, 2, 2)}
+	for i := 0; i < 10; i++ {
+		pieces = append(pieces, piece("helmet", Hash(10+i), false, 2+i, 11-i, 20, 20, 2, 2))
+	}
+	return pieces
+}
+
+func TestPlanArmorFindsTheBest(t *testing.T) {
+	type round struct {
+		pieces    []ArmorPiece
+		preferred []string
+		mods      int
+	}
+	rounds := []round{
+		{pieces: withPieces(balancedHelmets()...), preferred: []string{"Discipline", "Recovery"}},
+		{pieces: withPieces(balancedHelmets()...), preferred: []string{"Discipline", "Recovery"}, mods: 2},
+	}
+	random := rand.New(rand.NewSource(7))
+	for i := 0; i < 20; i++ {
+		//some rounds have more pieces a slot than any shortlist would keep
+		perSlot := 6
+		if i%4 == 0 {
+			perSlot = 12
+		}
+		rounds = append(rounds, round{
+			pieces:    randomArmor(random, perSlot),
+			preferred: []string{StatOrder[random.Intn(len(StatOrder))], StatOrder[random.Intn(len(StatOrder))]},
+			mods:      random.Intn(len(ArmorSlots) + 1),
+		})
+	}
+
+	for i, test := range rounds {
+		plan, err := PlanArmor(test.pieces, test.preferred, PlanOptions{Mods: test.mods})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := planScore(plan, test.preferred), exhaustive(test.pieces, test.preferred, test.mods); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("round %d: planned %v, the best is %v", i, got, want)
+		}
+	}
+}
+
+func TestPlanArmorFullVault(t *testing.T) {
+	pieces := randomArmor(rand.New(rand.NewSource(3)), MaxArmorPerSlot)
+	plan, err := PlanArmor(pieces, []string{"Recovery", "Discipline"}, PlanOptions{Mods: len(ArmorSlots)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the bound has to skip nearly all of the 60^5 combinations
+	if plan.Combinations > 100000 {
+		t.Errorf("scored %d combinations for %d pieces a slot", plan.Combinations, MaxArmorPerSlot)
+	}
+}
+
+func BenchmarkPlanArmor(b *testing.B) {
+	for _, perSlot := range []int{25, MaxArmorPerSlot} {
+		pieces := randomArmor(rand.New(rand.NewSource(3)), perSlot)
+		b.Run(fmt.Sprint(perSlot), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				plan, err := PlanArmor(pieces, []string{"Recovery", "Discipline"}, PlanOptions{Mods: len(ArmorSlots)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(plan.Combinations), "combinations")
+			}
+		})
+	}
+}
+
+func TestPostBuildPlanRefusesTooMuchArmor(t *testing.T) {
+	testManifest(t, fixtureTables{itemTable: {
+		500: `{"displayProperties":{"name":"Nezarec's Sin"},"classType":2,"inventory":{"bucketTypeHash":3448274439,"tierType":5}}`,
+	}})
+	stored, err := testBuilds(t).Create("warlock", "", fixtureBuild(t, `{"name":"Void","preference":["Recovery"]}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	armor := make([]string, MaxArmorPerSlot+1)
+	for i := range armor {
+		armor[i] = `{"hash":500,"stats":{"Recovery":20}}`
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/destiny/builds/{id}/plan", PostBuildPlan).Methods("POST")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/destiny/builds/"+stored.ID+"/plan", strings.NewReader(`{"armor":[`+strings.Join(armor, ",")+`]}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "more than") {
+		t.Errorf("expected 400 for %d helmets, got %d: %s", len(armor), w.Code, w.Body.String())
+	}
+}
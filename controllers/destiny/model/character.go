@@ -1,15 +1,12 @@
 package model
 
 import (
-	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"projector/controllers/destiny"
+	"projector/controllers/functions"
 	"strconv"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var base string = "https://www.bungie.net/Platform"
@@ -30,11 +27,11 @@ type Message struct {
 	Response string `json:"response"`
 }
 
-func (requestheader *RequestHeader) Send(URL, method string) []byte { //
+func (requestheader *RequestHeader) Send(URL, method string) ([]byte, error) { //
 	client := http.Client{}
 	request, error := http.NewRequest(method, URL, nil)
 	if error != nil {
-		log.Fatal("Unable to create request")
+		return nil, functions.Internal("Unable to create request", error)
 	}
 	request.Header.Add("X-API-KEY", requestheader.APIKey)
 	request.Header.Add("Authorization", requestheader.Authorization)
@@ -42,19 +39,22 @@ func (requestheader *RequestHeader) Send(URL, method string) []byte { //
 	response, error := client.Do(request)
 
 	if error != nil {
-		log.Fatal("Unable to send request to bungie")
+		return nil, functions.Upstream("Unable to send request to bungie", 0, error)
 	}
 
 	defer response.Body.Close()
 	body, error := ioutil.ReadAll(response.Body)
 	if error != nil {
-		log.Fatal("Unable to read data")
+		return nil, functions.Upstream("Unable to read data", 0, error)
+	}
+	if response.StatusCode >= 300 {
+		return nil, functions.Upstream("Bungie refused the request", response.StatusCode, nil)
 	}
 
 	//fmt.Println(string(body))
 	//fmt.Println("------------------------------------")
 
-	return body
+	return body, nil
 }
 
 type User struct {
@@ -107,63 +107,56 @@ type ProfileData struct {
 	} `json:"Response"`
 }
 
-func InitUser() {
+func InitUser() error {
 	req := RequestHeader{APIKey: key, Authorization: auth}
 
 	var userdata UserData
 
-	error := json.Unmarshal(req.Send(base+"/User/GetMembershipsForCurrentUser/", "GET"), &userdata)
+	body, error := req.Send(base+"/User/GetMembershipsForCurrentUser/", "GET")
+	if error != nil {
+		return error
+	}
+	error = json.Unmarshal(body, &userdata)
 	if error != nil {
-		log.Fatal("Unable to read data")
+		return functions.Internal("Unable to read data", error)
+	}
+	if len(userdata.Response.DestinyMemberships) == 0 {
+		return functions.NotFound("No destiny memberships found")
 	}
 
 	//"https://www.bungie.net/Platform/Destiny2/" + str(user['membershipType']) + "/Profile/" + str(user['membershipId']) + "/?components=100"
 	var profiledata ProfileData
 	newType := strconv.Itoa(userdata.Response.DestinyMemberships[0].MembershipType)
-	error = json.Unmarshal(req.Send(base+"/Destiny2/"+newType+"/Profile/"+userdata.Response.DestinyMemberships[0].MembershipID+"/?components=100", "GET"), &profiledata)
+	body, error = req.Send(base+"/Destiny2/"+newType+"/Profile/"+userdata.Response.DestinyMemberships[0].MembershipID+"/?components=100", "GET")
 	if error != nil {
-		log.Fatal("Unable to read data")
+		return error
 	}
-
-	db, error := sql.Open("sqlite3", "./controllers/destiny/manifest/world_sql_content_f5d265c7cb4dc5794bc2006c58a1f33b.content")
+	error = json.Unmarshal(body, &profiledata)
 	if error != nil {
-		log.Fatal("Unable to read data")
-		//m := Message{Response: "Unable to load destiny manifest file"}
-		//json.NewEncoder(w).Encode(m)
-		//return
+		return functions.Internal("Unable to read data", error)
 	}
 
+	store := destiny.Manifest.Store(destiny.DefaultManifestLocale)
+
 	for _, characterID := range profiledata.Response.Profile.Data.CharacterIds {
 		var characterdata CharacterData
-		error = json.Unmarshal(req.Send(base+"/Destiny2/"+newType+"/Profile/"+userdata.Response.DestinyMemberships[0].MembershipID+"/Character/"+characterID+"/?components=200,205", "GET"), &characterdata)
+		body, error = req.Send(base+"/Destiny2/"+newType+"/Profile/"+userdata.Response.DestinyMemberships[0].MembershipID+"/Character/"+characterID+"/?components=200,205", "GET")
 		if error != nil {
-			log.Fatal("Unable to read data")
+			return error
+		}
+		error = json.Unmarshal(body, &characterdata)
+		if error != nil {
+			return functions.Internal("Unable to read data", error)
 		}
 		
 		//var items []Item
 		for _, item := range characterdata.Response.Equipment.Data.Items {
-			newHash := strconv.Itoa(int(item.ItemHash))
-			rows, error := db.Query("SELECT * FROM DestinyInventoryItemDefinition WHERE id='" + newHash + "';")
-			if error != nil {
-				log.Fatal("Unable to read data asd")
-				//m := Message{Response: "Unable to query the destiny manifest"}
-				//json.NewEncoder(w).Encode(m)
-				//return
-			}
-			
-			var itemdata Item
-			var itemid int
-			
-			for rows.Next() {1
-				rows.Scan(&itemid, &itemdata)
-				//items = append(items, itemdata)
-				
-				fmt.Println(itemdata)
-				fmt.Println("-----------------")
-				//break
-				//data := Data{Id: strconv.Itoa(id), Json: jsondata}
-				//json.NewEncoder(w).Encode(data)
+			if _, error := store.GetRaw("DestinyInventoryItemDefinition", item.ItemHash); error != nil {
+				return destiny.ManifestHTTPError(error)
 			}
+			//break
+			//data := Data{Id: strconv.Itoa(id), Json: jsondata}
+			//json.NewEncoder(w).Encode(data)
 			
 			
 			
@@ -228,7 +221,7 @@ func InitUser() {
 	}
 
 	//return userdata
-
+	return nil
 }
 
 type CharacterData struct {
@@ -250,7 +243,7 @@ type CharacterData struct {
 		Equipment struct {
 			Data struct {
 				Items []struct {
-					ItemHash              int64  `json:"itemHash"`
+					ItemHash              destiny.Hash `json:"itemHash"`
 					ItemInstanceID        string `json:"itemInstanceId"`
 					Quantity              int    `json:"quantity"`
 					BindStatus            int    `json:"bindStatus"`
@@ -422,7 +415,7 @@ type Item struct {
 	IsWrapper                         bool     `json:"isWrapper"`
 	TraitIds                          []string `json:"traitIds"`
 	TraitHashes                       []int64  `json:"traitHashes"`
-	Hash                              int      `json:"hash"`
+	Hash                              destiny.Hash `json:"hash"`
 	Index                             int      `json:"index"`
 	Redacted                          bool     `json:"redacted"`
 	Blacklisted                       bool     `json:"blacklisted"`
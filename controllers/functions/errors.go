@@ -0,0 +1,85 @@
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error is the error every handler answers with, wrapped in {"error": ...}
+type Error struct {
+	Status         int    `json:"status"`
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	UpstreamStatus int    `json:"upstreamStatus,omitempty"`
+	Retryable      bool   `json:"retryable"`
+
+	Err error `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NewError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return NewError(http.StatusBadRequest, "bad_request", message)
+}
+
+func NotFound(message string) *Error {
+	return NewError(http.StatusNotFound, "not_found", message)
+}
+
+func Internal(message string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal", Message: message, Err: err}
+}
+
+// Upstream describes a failed call to youtube or bungie, the status we answer with follows what the upstream said
+func Upstream(message string, upstreamStatus int, err error) *Error {
+	e := &Error{Message: message, UpstreamStatus: upstreamStatus, Err: err}
+	switch {
+	case upstreamStatus == http.StatusUnauthorized:
+		e.Status, e.Code = http.StatusUnauthorized, "unauthorized"
+	case upstreamStatus == http.StatusForbidden:
+		e.Status, e.Code = http.StatusForbidden, "forbidden"
+	case upstreamStatus == http.StatusNotFound:
+		e.Status, e.Code = http.StatusNotFound, "not_found"
+	case upstreamStatus == http.StatusTooManyRequests:
+		e.Status, e.Code, e.Retryable = http.StatusServiceUnavailable, "rate_limited", true
+	case upstreamStatus == 0 || upstreamStatus >= 500:
+		//no answer at all or the upstream fell over, worth trying again
+		e.Status, e.Code, e.Retryable = http.StatusBadGateway, "upstream_unavailable", true
+	default:
+		e.Status, e.Code = http.StatusBadGateway, "upstream_error"
+	}
+	return e
+}
+
+// AsError turns any error into an *Error, unknown errors become internal ones
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal("Something went wrong", err)
+}
+
+// WriteError answers the request with the JSON error envelope and a matching status code
+func WriteError(w http.ResponseWriter, err error) {
+	e := AsError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error *Error `json:"error"`
+	}{e})
+}
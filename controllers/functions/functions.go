@@ -48,23 +48,20 @@ func Gamesshow(w http.ResponseWriter, router *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonFile, err := os.Open("../resources/QnA.json")
 	if err != nil {
-		m := Message{Response: "Unable to open file"}
-		json.NewEncoder(w).Encode(m)
+		WriteError(w, Internal("Unable to open file", err))
 		return
 	}
 	defer jsonFile.Close()
 
 	jsonData, err := ioutil.ReadAll(jsonFile)
 	if err != nil {
-		m := Message{Response: "Unable to read file"}
-		json.NewEncoder(w).Encode(m)
+		WriteError(w, Internal("Unable to read file", err))
 		return
 	}
 	data := QnA{}
 	err2 := json.Unmarshal(jsonData, &data)
 	if err2 != nil {
-		m := Message{Response: "Unable to read json data"}
-		json.NewEncoder(w).Encode(m)
+		WriteError(w, Internal("Unable to read json data", err2))
 		return
 	}
 	json.NewEncoder(w).Encode(data)
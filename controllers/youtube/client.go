@@ -0,0 +1,320 @@
+package youtube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const DefaultBaseURL = "https://youtube.googleapis.com/youtube/v3"
+
+// TokenSource hands out the oauth access token used for each request
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource for a token the frontend already fetched
+type StaticToken string
+
+func (token StaticToken) Token() (string, error) {
+	return string(token), nil
+}
+
+// Client talks to the parts of the youtube data api the handlers need
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Tokens     TokenSource
+
+	Channels      *ChannelsService
+	PlaylistItems *PlaylistItemsService
+	Videos        *VideosService
+}
+
+func NewClient(tokens TokenSource) *Client {
+	client := &Client{BaseURL: DefaultBaseURL, HTTPClient: &http.Client{}, Tokens: tokens}
+	client.Channels = &ChannelsService{client: client}
+	client.PlaylistItems = &PlaylistItemsService{client: client}
+	client.Videos = &VideosService{client: client}
+	return client
+}
+
+// Error is the error body google sends back with every failed request
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	Status     string `json:"status"`
+	Errors     []struct {
+		Reason  string `json:"reason"`
+		Domain  string `json:"domain"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("youtube answered %d", e.StatusCode)
+	}
+	return fmt.Sprintf("youtube answered %d: %s", e.StatusCode, e.Message)
+}
+
+// Reason returns the reason of the first error entry, e.g. quotaExceeded
+func (e *Error) Reason() string {
+	if len(e.Errors) == 0 {
+		return ""
+	}
+	return e.Errors[0].Reason
+}
+
+// do sends an authorized request and decodes the answer into out when given
+func (client *Client) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = data
+	}
+
+	request, err := http.NewRequest(method, client.BaseURL+path+"?"+query.Encode(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Accept", "application/json")
+	request.Header.Add("Content-Type", "application/json")
+	if client.Tokens != nil {
+		token, err := client.Tokens.Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	response, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= 300 {
+		var failure struct {
+			Error Error `json:"error"`
+		}
+		json.Unmarshal(data, &failure)
+		failure.Error.StatusCode = response.StatusCode
+		return &failure.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+type ChannelsService struct {
+	client *Client
+}
+
+type ChannelList struct {
+	Items []struct {
+		ID             string `json:"id"`
+		ContentDetails struct {
+			RelatedPlaylists struct {
+				Likes   string `json:"likes"`
+				Uploads string `json:"uploads"`
+			} `json:"relatedPlaylists"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+	PageInfo PageInfo `json:"pageInfo"`
+}
+
+type PageInfo struct {
+	ResultsPerPage int `json:"resultsPerPage"`
+	TotalResults   int `json:"totalResults"`
+}
+
+// Mine lists the channels of the token owner
+func (service *ChannelsService) Mine() (*ChannelList, error) {
+	query := url.Values{"part": {"contentDetails"}, "mine": {"true"}}
+	var list ChannelList
+	if err := service.client.do("GET", "/channels", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+type PlaylistItemsService struct {
+	client *Client
+}
+
+type PlaylistItemsRequest struct {
+	PlaylistID string
+	Part       []string
+	MaxResults int
+	PageToken  string
+}
+
+type Thumbnail struct {
+	URL string `json:"url"`
+}
+
+type PlaylistItem struct {
+	ID             string `json:"id"`
+	ContentDetails struct {
+		VideoID string `json:"videoId"`
+	} `json:"contentDetails"`
+	Snippet struct {
+		Title       string `json:"title"`
+		PublishedAt string `json:"publishedAt"`
+		Position    int    `json:"position"`
+		Thumbnails  struct {
+			Default Thumbnail `json:"default"`
+			Medium  Thumbnail `json:"medium"`
+			High    Thumbnail `json:"high"`
+		} `json:"thumbnails"`
+	} `json:"snippet"`
+}
+
+type PlaylistItemList struct {
+	NextPageToken string         `json:"nextPageToken"`
+	Items         []PlaylistItem `json:"items"`
+	PageInfo      PageInfo       `json:"pageInfo"`
+}
+
+func (service *PlaylistItemsService) List(request PlaylistItemsRequest) (*PlaylistItemList, error) {
+	part := request.Part
+	if len(part) == 0 {
+		part = []string{"contentDetails", "snippet"}
+	}
+	maxResults := request.MaxResults
+	if maxResults == 0 {
+		maxResults = 50
+	}
+
+	query := url.Values{
+		"part":       {strings.Join(part, ",")},
+		"maxResults": {strconv.Itoa(maxResults)},
+		"playlistId": {request.PlaylistID},
+	}
+	if request.PageToken != "" {
+		query.Set("pageToken", request.PageToken)
+	}
+
+	var list PlaylistItemList
+	if err := service.client.do("GET", "/playlistItems", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Pages walks the playlist one page at a time following nextPageToken
+func (service *PlaylistItemsService) Pages(request PlaylistItemsRequest) *PlaylistItemsIterator {
+	return &PlaylistItemsIterator{service: service, request: request}
+}
+
+type PlaylistItemsIterator struct {
+	service *PlaylistItemsService
+	request PlaylistItemsRequest
+	page    *PlaylistItemList
+	err     error
+	done    bool
+}
+
+// Next fetches the next page, returning false once the playlist is exhausted or a request failed
+func (iterator *PlaylistItemsIterator) Next() bool {
+	if iterator.done {
+		return false
+	}
+
+	iterator.page, iterator.err = iterator.service.List(iterator.request)
+	if iterator.err != nil {
+		iterator.done = true
+		return false
+	}
+
+	iterator.request.PageToken = iterator.page.NextPageToken
+	iterator.done = iterator.page.NextPageToken == ""
+	return true
+}
+
+func (iterator *PlaylistItemsIterator) Page() *PlaylistItemList {
+	return iterator.page
+}
+
+func (iterator *PlaylistItemsIterator) Err() error {
+	return iterator.err
+}
+
+type VideosService struct {
+	client *Client
+}
+
+type VideosRequest struct {
+	IDs  []string
+	Part []string
+}
+
+type VideoSnippet struct {
+	Title           string   `json:"title"`
+	Description     string   `json:"description"`
+	Tags            []string `json:"tags,omitempty"`
+	CategoryID      string   `json:"categoryId"`
+	DefaultLanguage string   `json:"defaultLanguage,omitempty"`
+}
+
+type Video struct {
+	ID             string        `json:"id"`
+	Snippet        *VideoSnippet `json:"snippet,omitempty"`
+	ContentDetails *struct {
+		Duration string `json:"duration"`
+	} `json:"contentDetails,omitempty"`
+	Statistics *struct {
+		ViewCount    string `json:"viewCount"`
+		LikeCount    string `json:"likeCount"`
+		CommentCount string `json:"commentCount"`
+	} `json:"statistics,omitempty"`
+}
+
+type VideoList struct {
+	Items []Video `json:"items"`
+}
+
+// List fetches the given videos, at most 50 ids per call
+func (service *VideosService) List(request VideosRequest) (*VideoList, error) {
+	if len(request.IDs) > 50 {
+		return nil, fmt.Errorf("videos.list takes at most 50 ids, got %d", len(request.IDs))
+	}
+	part := request.Part
+	if len(part) == 0 {
+		part = []string{"snippet", "contentDetails"}
+	}
+
+	query := url.Values{"part": {strings.Join(part, ",")}, "id": {strings.Join(request.IDs, ",")}}
+	var list VideoList
+	if err := service.client.do("GET", "/videos", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Update writes the given parts of the video back, youtube replaces each part as a whole
+func (service *VideosService) Update(part string, video Video) (*Video, error) {
+	query := url.Values{"part": {part}}
+	var updated Video
+	if err := service.client.do("PUT", "/videos", query, video, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
@@ -0,0 +1,73 @@
+package youtube
+
+import (
+	"sort"
+	"strconv"
+)
+
+// enrichVideos fills in duration, views and likes from videos.list, 50 ids per call
+func enrichVideos(client *Client, videos []PlaylistVideo) error {
+	for start := 0; start < len(videos); start += 50 {
+		end := start + 50
+		if end > len(videos) {
+			end = len(videos)
+		}
+
+		ids := make([]string, 0, end-start)
+		for _, video := range videos[start:end] {
+			ids = append(ids, video.ID)
+		}
+
+		list, err := client.Videos.List(VideosRequest{IDs: ids, Part: []string{"contentDetails", "statistics"}})
+		if err != nil {
+			return err
+		}
+
+		details := make(map[string]Video, len(list.Items))
+		for _, video := range list.Items {
+			details[video.ID] = video
+		}
+
+		for i := start; i < end; i++ {
+			video, ok := details[videos[i].ID]
+			if !ok {
+				//deleted and private videos are left out of videos.list
+				continue
+			}
+			if video.ContentDetails != nil {
+				duration, _ := parseDuration(video.ContentDetails.Duration)
+				videos[i].Duration = int(duration.Seconds())
+			}
+			if video.Statistics != nil {
+				videos[i].Views, _ = strconv.ParseInt(video.Statistics.ViewCount, 10, 64)
+				videos[i].Likes, _ = strconv.ParseInt(video.Statistics.LikeCount, 10, 64)
+			}
+		}
+	}
+	return nil
+}
+
+func validSort(sortBy string) bool {
+	return sortBy == "duration" || sortBy == "views" || sortBy == "published"
+}
+
+func sortVideos(videos []PlaylistVideo, sortBy string, descending bool) {
+	less := func(a, b PlaylistVideo) bool {
+		switch sortBy {
+		case "duration":
+			return a.Duration < b.Duration
+		case "views":
+			return a.Views < b.Views
+		default:
+			//publishedAt is RFC 3339, so it sorts as a string
+			return a.PublishedAt < b.PublishedAt
+		}
+	}
+
+	sort.SliceStable(videos, func(i, j int) bool {
+		if descending {
+			return less(videos[j], videos[i])
+		}
+		return less(videos[i], videos[j])
+	})
+}
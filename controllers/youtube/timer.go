@@ -0,0 +1,164 @@
+package youtube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// youtube refuses titles longer than this
+const maxTitleLength = 100
+
+var (
+	durationPattern = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+	timerPattern    = regexp.MustCompile(`^\[\d+:\d{2}\]\s*|\s*\[\d+:\d{2}\]$`)
+)
+
+type TitleResult struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	NewTitle string `json:"newTitle,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type TitleReport struct {
+	Changed []TitleResult `json:"changed"`
+	Skipped []TitleResult `json:"skipped"`
+	Failed  []TitleResult `json:"failed"`
+}
+
+// PutTimerOnVidsTitle puts a [mm:ss] timer in front of (or behind, with position=suffix) the title of every video in a playlist
+func PutTimerOnVidsTitle(w http.ResponseWriter, router *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := router.URL.Query().Get("token")
+	playlist := router.URL.Query().Get("playlist")
+	suffix := router.URL.Query().Get("position") == "suffix"
+
+	if token == "" || playlist == "" {
+		functions.WriteError(w, functions.BadRequest("Both token and playlist are required"))
+		return
+	}
+
+	client := newClient(token)
+
+	//collecting every video id in the playlist
+	var ids []string
+	pages := client.PlaylistItems.Pages(PlaylistItemsRequest{PlaylistID: playlist, Part: []string{"contentDetails"}})
+	for pages.Next() {
+		for _, item := range pages.Page().Items {
+			ids = append(ids, item.ContentDetails.VideoID)
+		}
+	}
+	if pages.Err() != nil {
+		functions.WriteError(w, upstreamError("Unable to read the playlist", pages.Err()))
+		return
+	}
+
+	report := TitleReport{Changed: []TitleResult{}, Skipped: []TitleResult{}, Failed: []TitleResult{}}
+
+	//videos.list takes at most 50 ids at a time
+	for start := 0; start < len(ids); start += 50 {
+		end := start + 50
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		videos, err := client.Videos.List(VideosRequest{IDs: ids[start:end]})
+		if err != nil {
+			for _, id := range ids[start:end] {
+				report.Failed = append(report.Failed, TitleResult{ID: id, Reason: err.Error()})
+			}
+			continue
+		}
+
+		//videos.list leaves out deleted and private videos instead of failing on them
+		returned := make(map[string]bool, len(videos.Items))
+		for _, video := range videos.Items {
+			returned[video.ID] = true
+		}
+		for _, id := range ids[start:end] {
+			if !returned[id] {
+				report.Skipped = append(report.Skipped, TitleResult{ID: id, Reason: "Video is not available, it may be private or deleted"})
+			}
+		}
+
+		for _, video := range videos.Items {
+			if video.Snippet == nil || video.ContentDetails == nil {
+				report.Failed = append(report.Failed, TitleResult{ID: video.ID, Reason: "Video details are missing"})
+				continue
+			}
+			result := TitleResult{ID: video.ID, Title: video.Snippet.Title}
+
+			duration, err := parseDuration(video.ContentDetails.Duration)
+			if err != nil || duration == 0 {
+				result.Reason = "Video has no duration"
+				report.Skipped = append(report.Skipped, result)
+				continue
+			}
+
+			result.NewTitle = timerTitle(video.Snippet.Title, duration, suffix)
+			if result.NewTitle == video.Snippet.Title {
+				result.Reason = "Title already has the timer"
+				report.Skipped = append(report.Skipped, result)
+				continue
+			}
+			if len([]rune(result.NewTitle)) > maxTitleLength {
+				result.Reason = "Title would exceed " + strconv.Itoa(maxTitleLength) + " characters"
+				report.Skipped = append(report.Skipped, result)
+				continue
+			}
+
+			//videos.update replaces the whole snippet, so the rest of it is sent back untouched
+			snippet := *video.Snippet
+			snippet.Title = result.NewTitle
+			if _, err := client.Videos.Update("snippet", Video{ID: video.ID, Snippet: &snippet}); err != nil {
+				result.Reason = err.Error()
+				report.Failed = append(report.Failed, result)
+				continue
+			}
+			report.Changed = append(report.Changed, result)
+		}
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// parseDuration reads the ISO-8601 durations youtube uses, e.g. PT1H2M3S
+func parseDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return 0, err
+		}
+		duration += time.Duration(n) * unit
+	}
+	return duration, nil
+}
+
+// timerTitle swaps any existing timer in the title for a fresh one
+func timerTitle(title string, duration time.Duration, suffix bool) string {
+	seconds := int(duration.Seconds())
+	timer := fmt.Sprintf("[%02d:%02d]", seconds/60, seconds%60)
+
+	title = strings.TrimSpace(timerPattern.ReplaceAllString(title, ""))
+	if suffix {
+		return title + " " + timer
+	}
+	return timer + " " + title
+}
@@ -0,0 +1,146 @@
+package youtube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeYoutube stands in for the data api: a two page playlist and a videos endpoint
+// that leaves out the ids it has no video for and fails to update "broken"
+func fakeYoutube(t *testing.T, videos map[string]Video, updated map[string]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/playlistItems":
+			ids, next := []string{"plain", "timed", "long"}, "page2"
+			if r.URL.Query().Get("pageToken") == "page2" {
+				ids, next = []string{"broken", "live", "deleted"}, ""
+			}
+			var list PlaylistItemList
+			list.NextPageToken = next
+			for _, id := range ids {
+				var item PlaylistItem
+				item.ContentDetails.VideoID = id
+				list.Items = append(list.Items, item)
+			}
+			json.NewEncoder(w).Encode(list)
+
+		case r.Method == "GET" && r.URL.Path == "/videos":
+			var list VideoList
+			for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+				if video, ok := videos[id]; ok {
+					list.Items = append(list.Items, video)
+				}
+			}
+			json.NewEncoder(w).Encode(list)
+
+		case r.Method == "PUT" && r.URL.Path == "/videos":
+			var video Video
+			if err := json.NewDecoder(r.Body).Decode(&video); err != nil {
+				t.Errorf("unable to read the update: %v", err)
+			}
+			if video.ID == "broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{"error":{"code":500,"message":"backend error"}}`)
+				return
+			}
+			mu.Lock()
+			updated[video.ID] = video.Snippet.Title
+			mu.Unlock()
+			json.NewEncoder(w).Encode(video)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func video(id, title, duration string) Video {
+	return Video{
+		ID:      id,
+		Snippet: &VideoSnippet{Title: title, CategoryID: "20"},
+		ContentDetails: &struct {
+			Duration string `json:"duration"`
+		}{Duration: duration},
+	}
+}
+
+func TestPutTimerOnVidsTitle(t *testing.T) {
+	videos := map[string]Video{
+		"plain":  video("plain", "Raid night", "PT3M5S"),
+		"timed":  video("timed", "[01:00] Already done", "PT1M"),
+		"long":   video("long", strings.Repeat("x", 95), "PT10M"),
+		"broken": video("broken", "Will fail", "PT2M"),
+		"live":   video("live", "Live stream", "P0D"),
+	}
+	updated := make(map[string]string)
+	server := fakeYoutube(t, videos, updated)
+	defer server.Close()
+
+	defer func(base string) { apiBase = base }(apiBase)
+	apiBase = server.URL
+
+	w := httptest.NewRecorder()
+	PutTimerOnVidsTitle(w, httptest.NewRequest("PUT", "/api/youtube/?token=abc&playlist=PL1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var report TitleReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := func(results []TitleResult) map[string]string {
+		byID := make(map[string]string, len(results))
+		for _, result := range results {
+			byID[result.ID] = result.Reason
+		}
+		return byID
+	}
+
+	changed := reasons(report.Changed)
+	if len(changed) != 1 || updated["plain"] != "[03:05] Raid night" {
+		t.Errorf("expected only plain to change to [03:05] Raid night, got %v, updated %v", report.Changed, updated)
+	}
+	if _, ok := changed["plain"]; !ok {
+		t.Errorf("plain is not reported as changed: %v", report.Changed)
+	}
+
+	skipped := reasons(report.Skipped)
+	for id, reason := range map[string]string{
+		"timed":   "Title already has the timer",
+		"long":    "Title would exceed 100 characters",
+		"live":    "Video has no duration",
+		"deleted": "Video is not available, it may be private or deleted",
+	} {
+		if skipped[id] != reason {
+			t.Errorf("expected %s skipped with %q, got %q", id, reason, skipped[id])
+		}
+	}
+	if len(skipped) != 4 {
+		t.Errorf("expected 4 skipped videos, got %v", report.Skipped)
+	}
+
+	failed := reasons(report.Failed)
+	if len(failed) != 1 || !strings.Contains(failed["broken"], "backend error") {
+		t.Errorf("expected broken to fail with the youtube error, got %v", report.Failed)
+	}
+	if _, ok := updated["broken"]; ok {
+		t.Errorf("broken should not have been updated")
+	}
+}
+
+func TestPutTimerOnVidsTitleNeedsPlaylist(t *testing.T) {
+	w := httptest.NewRecorder()
+	PutTimerOnVidsTitle(w, httptest.NewRequest("PUT", "/api/youtube/?token=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a playlist, got %d", w.Code)
+	}
+}
@@ -1,117 +1,224 @@
 package youtube
 
 import (
-	"net/http"
-	//"github.com/gorilla/mux"
-	"io/ioutil"
-	"fmt"
-	"log"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"projector/controllers/functions"
+	"strconv"
 )
 
+// base url the handlers point their client at, overridable so they can be run against a local fake
+var apiBase = DefaultBaseURL
+
+// hard cap on how many videos all=true will walk through
+const maxPlaylistVideos = 5000
+
+type PlaylistVideo struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	PublishedAt string `json:"publishedAt"`
+	Thumbnail   string `json:"thumbnail"`
+	Position    int    `json:"position"`
+	Duration    int    `json:"duration"`
+	Views       int64  `json:"views"`
+	Likes       int64  `json:"likes"`
+}
 
-type Playlist struct {
-	Etag  string `json:"etag"`
-	Items []struct {
-		ContentDetails struct {
-			RelatedPlaylists struct {
-				Likes   string `json:"likes"`
-				Uploads string `json:"uploads"`
-			} `json:"relatedPlaylists"`
-		} `json:"contentDetails"`
-		Etag string `json:"etag"`
-		ID   string `json:"id"`
-		Kind string `json:"kind"`
-	} `json:"items"`
-	Kind     string `json:"kind"`
-	PageInfo struct {
-		ResultsPerPage int `json:"resultsPerPage"`
-		TotalResults   int `json:"totalResults"`
-	} `json:"pageInfo"`
+type PlaylistPage struct {
+	Items         []PlaylistVideo `json:"items"`
+	NextPageToken string          `json:"nextPageToken,omitempty"`
+	TotalResults  int             `json:"totalResults"`
 }
 
-func GetPlaylist(w http.ResponseWriter, router *http.Request){
+// GetPlaylist returns a page of the given playlist (or the uploads of the token owner), or every video in it with all=true
+func GetPlaylist(w http.ResponseWriter, router *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	token := router.URL.Query().Get("token")
 	playlist := router.URL.Query().Get("playlist")
 	next := router.URL.Query().Get("next")
-	//token := mux.Vars(router)["token"]
-	//next := mux.Vars(router)["next"]
-	
 
-
-	client := http.Client{}
+	client := newClient(token)
 
 	if playlist == "" {
-		request, error := http.NewRequest("GET", "https://content-youtube.googleapis.com/youtube/v3/channels?part=contentDetails&mine=true", nil)
-		if error != nil {
-			log.Fatal("Unable to create request")
+		channels, err := client.Channels.Mine()
+		if err != nil {
+			functions.WriteError(w, upstreamError("Unable to find the uploads playlist", err))
+			return
+		}
+		if len(channels.Items) == 0 {
+			functions.WriteError(w, functions.NotFound("The token owner has no channel"))
+			return
 		}
-		request.Header.Add("Accept", "application/json")
-		request.Header.Add("Content-Type", "application/json")
-		request.Header.Add("Authorization", "Bearer " + token)
-		response, error := client.Do(request)
+		playlist = channels.Items[0].ContentDetails.RelatedPlaylists.Uploads
+	}
 
-		if error != nil {
-			log.Fatal("Unable to send request to bungie")
+	sortBy := router.URL.Query().Get("sort")
+	descending := router.URL.Query().Get("order") != "asc"
+	if sortBy != "" && !validSort(sortBy) {
+		functions.WriteError(w, functions.BadRequest("sort must be one of duration, views or published"))
+		return
+	}
+
+	request := PlaylistItemsRequest{PlaylistID: playlist, PageToken: next}
+
+	if router.URL.Query().Get("all") == "true" {
+		limit := maxPlaylistVideos
+		if n, err := strconv.Atoi(router.URL.Query().Get("limit")); err == nil && n > 0 && n < limit {
+			limit = n
 		}
+		request.PageToken = ""
+		pages := client.PlaylistItems.Pages(request)
 
-		defer response.Body.Close()
-		body, error := ioutil.ReadAll(response.Body)
-		if error != nil {
-			log.Fatal("Unable to read mobileworld data")
+		//sorting needs the whole playlist at hand, so only the unsorted output is streamed
+		if sortBy == "" {
+			streamPlaylist(w, client, pages, limit)
+			return
 		}
 
-		var data Playlist
-		json.Unmarshal(body, &data)
-		if error != nil {
-			log.Fatal("Unable to read mobileworld data")
+		var videos []PlaylistVideo
+		truncated := false
+		for !truncated && pages.Next() {
+			page := playlistVideos(pages.Page())
+			if len(videos)+len(page) > limit {
+				page = page[:limit-len(videos)]
+				truncated = true
+			}
+			videos = append(videos, page...)
+		}
+		if pages.Err() != nil {
+			functions.WriteError(w, upstreamError("Unable to read the playlist", pages.Err()))
+			return
+		}
+		if err := enrichVideos(client, videos); err != nil {
+			functions.WriteError(w, upstreamError("Unable to read the video details", err))
+			return
 		}
+		sortVideos(videos, sortBy, descending)
+
+		json.NewEncoder(w).Encode(struct {
+			Items     []PlaylistVideo `json:"items"`
+			Total     int             `json:"total"`
+			Truncated bool            `json:"truncated"`
+		}{videos, len(videos), truncated})
+		return
+	}
+
+	page, err := client.PlaylistItems.List(request)
+	if err != nil {
+		functions.WriteError(w, upstreamError("Unable to read the playlist", err))
+		return
+	}
 
-		playlist = data.Items[0].ContentDetails.RelatedPlaylists.Uploads
+	videos := playlistVideos(page)
+	if err := enrichVideos(client, videos); err != nil {
+		functions.WriteError(w, upstreamError("Unable to read the video details", err))
+		return
 	}
-	
-	var url string
-
-	
-	if next == "" {
-		url = "https://youtube.googleapis.com/youtube/v3/playlistItems?part=contentDetails&part=contentDetails,snippet&maxResults=50&playlistId="+playlist
-	}else{
-		url = "https://youtube.googleapis.com/youtube/v3/playlistItems?part=contentDetails&part=contentDetails,snippet&maxResults=50&playlistId="+playlist + "&pageToken="+next
+	if sortBy != "" {
+		sortVideos(videos, sortBy, descending)
 	}
-	fmt.Println(url)
 
-	request, error := http.NewRequest("GET", url, nil)
-	if error != nil {
-		log.Fatal("Unable to create request")
+	json.NewEncoder(w).Encode(PlaylistPage{
+		Items:         videos,
+		NextPageToken: page.NextPageToken,
+		TotalResults:  page.PageInfo.TotalResults,
+	})
+}
+
+// streamPlaylist writes the videos out page by page, so big playlists are never held in memory
+func streamPlaylist(w http.ResponseWriter, client *Client, pages *PlaylistItemsIterator, limit int) {
+	if !pages.Next() {
+		functions.WriteError(w, upstreamError("Unable to read the playlist", pages.Err()))
+		return
 	}
-	request.Header.Add("Accept", "application/json")
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Authorization", "Bearer " + token)
-	response, error := client.Do(request)
 
-	if error != nil {
-		log.Fatal("Unable to send request to bungie")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+	truncated := false
+	var failure error
+
+	fmt.Fprint(w, `{"items":[`)
+	for {
+		videos := playlistVideos(pages.Page())
+		if written+len(videos) > limit {
+			videos = videos[:limit-written]
+			truncated = true
+		}
+		if failure = enrichVideos(client, videos); failure != nil {
+			break
+		}
+
+		for _, video := range videos {
+			if written > 0 {
+				fmt.Fprint(w, ",")
+			}
+			encoder.Encode(video)
+			written++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if truncated || !pages.Next() {
+			break
+		}
 	}
 
-	defer response.Body.Close()
-	body, error := ioutil.ReadAll(response.Body)
-	if error != nil {
-		log.Fatal("Unable to read mobileworld data")
+	if failure == nil {
+		failure = pages.Err()
 	}
 
-	videos := make(map[string]interface{})
-	json.Unmarshal(body, &videos)
-	if error != nil {
-		log.Fatal("Unable to read mobileworld data")
+	fmt.Fprintf(w, `],"total":%d,"truncated":%t`, written, truncated)
+	if failure != nil {
+		//the status is already sent, so the failure goes into the body instead
+		errorJSON, _ := json.Marshal(upstreamError("Unable to read the whole playlist", failure))
+		fmt.Fprintf(w, `,"error":%s`, errorJSON)
 	}
+	fmt.Fprint(w, "}\n")
+}
 
-	//fmt.Println(videos)
+// upstreamError wraps a failed youtube call into the shared error, keeping the status google answered with
+func upstreamError(message string, err error) *functions.Error {
+	var failure *Error
+	if !errors.As(err, &failure) {
+		return functions.Upstream(message, 0, err)
+	}
 
-	json.NewEncoder(w).Encode(videos)
+	upstream := functions.Upstream(message, failure.StatusCode, err)
+	if reason := failure.Reason(); reason == "quotaExceeded" || reason == "rateLimitExceeded" {
+		upstream.Status, upstream.Code, upstream.Retryable = http.StatusServiceUnavailable, "rate_limited", true
+	}
+	return upstream
+}
 
-	
+func newClient(token string) *Client {
+	client := NewClient(StaticToken(token))
+	client.BaseURL = apiBase
+	return client
+}
 
+func playlistVideos(page *PlaylistItemList) []PlaylistVideo {
+	videos := make([]PlaylistVideo, 0, len(page.Items))
+	for _, item := range page.Items {
+		thumbnail := item.Snippet.Thumbnails.High.URL
+		if thumbnail == "" {
+			thumbnail = item.Snippet.Thumbnails.Medium.URL
+		}
+		if thumbnail == "" {
+			thumbnail = item.Snippet.Thumbnails.Default.URL
+		}
 
-}
\ No newline at end of file
+		videos = append(videos, PlaylistVideo{
+			ID:          item.ContentDetails.VideoID,
+			Title:       item.Snippet.Title,
+			PublishedAt: item.Snippet.PublishedAt,
+			Thumbnail:   thumbnail,
+			Position:    item.Snippet.Position,
+		})
+	}
+	return videos
+}
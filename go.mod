@@ -1,6 +1,7 @@
 module projector
 
 // +heroku goVersion go1.17
+// +heroku install -tags sqlite_fts5 .
 go 1.17
 
 require (